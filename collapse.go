@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrorRun is a streak of identical errors (same method, code and message)
+// among a broker's completed requests, shown once with --collapse-errors.
+type ErrorRun struct {
+	Key   string
+	Count int
+	// how many of them the printed line accounts for
+	Shown int
+	Event *Event
+}
+
+// lastLine remembers whose error run, if any, is on the last line printed,
+// so it can be rewritten in place on a terminal.
+var lastLine struct {
+	sync.Mutex
+	run *ErrorRun
+}
+
+func errorKey(ev *Event) string {
+	return fmt.Sprintf("%s\x00%d\x00%s", ev.Method, ev.Error.Code, ev.Error.Message)
+}
+
+// printEvent prints the rendered line for ev. With --collapse-errors, an
+// error that repeats the broker's previous completion isn't printed again:
+// the count is added to the first line if it's still the last one on the
+// terminal, and otherwise printed when the run ends.
+func (b *Broker) printEvent(ev *Event) {
+	lastLine.Lock()
+	defer lastLine.Unlock()
+
+	if *collapseErrors && ev.Status == EventStatusPending && b.ErrorRun != nil && b.ErrorRun.Event.Method == ev.Method {
+		// likely to fail the same way, only show it if it doesn't
+		return
+	}
+
+	if !*collapseErrors || ev.Kind != EventKindRequest || ev.Status == EventStatusPending {
+		b.lineColor(ev).Printf("%s\n", b.Render(ev))
+		lastLine.run = nil
+		return
+	}
+
+	if ev.Status == EventStatusErrored && b.ErrorRun != nil && b.ErrorRun.Key == errorKey(ev) {
+		run := b.ErrorRun
+		run.Count++
+		if lastLine.run == run && isTerminal(os.Stdout) {
+			b.Color.Printf("\033[1A\033[2K%s (×%d)\n", b.Render(ev), run.Count)
+			run.Shown = run.Count
+		}
+		return
+	}
+
+	b.endErrorRunLocked()
+	b.Color.Printf("%s\n", b.Render(ev))
+	lastLine.run = nil
+	if ev.Status == EventStatusErrored {
+		b.ErrorRun = &ErrorRun{Key: errorKey(ev), Count: 1, Shown: 1, Event: ev}
+		lastLine.run = b.ErrorRun
+	}
+}
+
+// linePrinted must be called after printing anything other than an
+// event, so no error run gets rewritten over it.
+func linePrinted() {
+	lastLine.Lock()
+	defer lastLine.Unlock()
+	lastLine.run = nil
+}
+
+// endErrorRun prints how many times the broker's last error repeated,
+// if that's not already shown.
+func (b *Broker) endErrorRun() {
+	lastLine.Lock()
+	defer lastLine.Unlock()
+	b.endErrorRunLocked()
+}
+
+func (b *Broker) endErrorRunLocked() {
+	run := b.ErrorRun
+	if run == nil {
+		return
+	}
+	b.ErrorRun = nil
+
+	if n := run.Count - run.Shown; n > 0 {
+		times := "times"
+		if n == 1 {
+			times = "time"
+		}
+		b.Color.Printf("%s%s%s  %s ✕ [%s] %s failed the same way %d more %s\n", timestamp(time.Now().UTC()), b.Delta(), depthMark(0), pad("broker", b.Name, maxBrokerWidth), run.Event.ID, run.Event.Method, n, times)
+		lastLine.run = nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Columns grow to fit the widest value printed so far, up to a limit, so
+// that what follows them lines up from one line to the next.
+var columns struct {
+	sync.Mutex
+	widths map[string]int
+}
+
+const (
+	maxBrokerWidth = 24
+	maxIDWidth     = 16
+	maxMethodWidth = 32
+	// deepest nesting shown, as one dot per pending request
+	maxDepthWidth = 3
+)
+
+// pad returns s followed by enough spaces to fill its column.
+func pad(column string, s string, limit int) string {
+	n := utf8.RuneCountInString(s)
+
+	columns.Lock()
+	defer columns.Unlock()
+	if columns.widths == nil {
+		columns.widths = make(map[string]int)
+	}
+	width := columns.widths[column]
+	if n > width && n <= limit {
+		width = n
+	} else if n > width {
+		width = limit
+	}
+	columns.widths[column] = width
+
+	if n >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// depthMark shows how many requests are pending, in a fixed width.
+func depthMark(depth int) string {
+	if depth > maxDepthWidth {
+		depth = maxDepthWidth
+	}
+	return strings.Repeat("·", depth) + strings.Repeat(" ", maxDepthWidth-depth)
+}
+
+// idColumn is ev's id in brackets, or blank for notifications, padded
+// so that methods line up.
+func (ev *Event) idColumn() string {
+	id := ""
+	if ev.ID != "" {
+		id = "[" + ev.ID.String() + "]"
+	}
+	return pad("id", id, maxIDWidth)
+}
+
+// methodColumn is ev's method, padded so that what follows lines up. A
+// reply whose request wasn't seen has none.
+func (ev *Event) methodColumn() string {
+	method := ev.Method
+	switch {
+	case ev.Status == EventStatusOrphan:
+		method = "(no request)"
+	case method == "":
+		method = "(unknown method)"
+	}
+	return pad("method", method, maxMethodWidth)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+type controlCommand func(args []string) error
+
+var controlCommands = map[string]controlCommand{
+	"upstream": controlUpstream,
+	"observe":  controlObserve,
+	"dump":     controlDump,
+}
+
+// readControl reads one command per line from r, until EOF.
+func readControl(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		cmd, ok := controlCommands[fields[0]]
+		if !ok {
+			log.Printf("Unknown control command %q", fields[0])
+			continue
+		}
+
+		err := cmd(fields[1:])
+		if err != nil {
+			log.Printf("%s: %+v", fields[0], err)
+		}
+	}
+}
+
+func controlUpstream(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: upstream <host:port|unix:/path>")
+	}
+
+	address := args[0]
+	if network, _ := upstreamNetwork(address); network == "tcp" {
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	setUpstreamOverride(address)
+	log.Printf("New connections will now go to %s", address)
+	return nil
+}
+
+func controlObserve(args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return fmt.Errorf("usage: observe on|off")
+	}
+
+	if args[0] == "off" {
+		atomic.StoreInt32(&observationPaused, 1)
+		log.Printf("Observation paused, only forwarding messages")
+	} else {
+		atomic.StoreInt32(&observationPaused, 0)
+		log.Printf("Observation resumed")
+	}
+	return nil
+}
+
+func controlDump(args []string) error {
+	path, err := dumpBrokers(*dumpDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote broker state to %s", path)
+	return nil
+}
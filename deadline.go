@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// deadlineOf reads the --deadline-field of a request that started at start.
+// Deadlines may be a number of milliseconds, a duration like "1.5s",
+// or an RFC 3339 timestamp. Returns 0 if there's no usable deadline.
+func deadlineOf(msgString string, start time.Time) time.Duration {
+	if *deadlineField == "" {
+		return 0
+	}
+
+	value, ok := extractPath([]byte(msgString), *deadlineField)
+	if !ok {
+		return 0
+	}
+
+	var ms float64
+	if json.Unmarshal(value, &ms) == nil {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	var s string
+	if json.Unmarshal(value, &s) != nil {
+		return 0
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Sub(start)
+	}
+	return 0
+}
+
+// checkDeadline marks ev if it took longer than its client said it could.
+func (ev *Event) checkDeadline() {
+	if ev.Deadline > 0 && ev.Duration() > ev.Deadline {
+		ev.DeadlineExceeded = true
+	}
+}
+
+// timing formats how long ev took, and how that compares to its deadline.
+func (ev *Event) timing() string {
+	if ev.DeadlineExceeded {
+		return fmt.Sprintf("%s ⏰ over %s deadline", ev.Duration(), ev.Deadline)
+	}
+	return ev.Duration().String()
+}
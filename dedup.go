@@ -0,0 +1,74 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// how many recent requests each broker remembers for --dup-window
+const recentRequestsSize = 256
+
+type recentRequest struct {
+	key    string
+	seenAt time.Time
+}
+
+// RecentRequests is a small LRU of request fingerprints.
+type RecentRequests struct {
+	order *list.List
+	byKey map[string]*list.Element
+}
+
+func newRecentRequests() *RecentRequests {
+	return &RecentRequests{
+		order: list.New(),
+		byKey: make(map[string]*list.Element),
+	}
+}
+
+// Seen records key and returns when it was last seen before, if ever.
+func (rr *RecentRequests) Seen(key string, t time.Time) (time.Time, bool) {
+	if el, ok := rr.byKey[key]; ok {
+		entry := el.Value.(*recentRequest)
+		previous := entry.seenAt
+		entry.seenAt = t
+		rr.order.MoveToFront(el)
+		return previous, true
+	}
+
+	rr.byKey[key] = rr.order.PushFront(&recentRequest{key: key, seenAt: t})
+	if rr.order.Len() > recentRequestsSize {
+		oldest := rr.order.Back()
+		rr.order.Remove(oldest)
+		delete(rr.byKey, oldest.Value.(*recentRequest).key)
+	}
+	return time.Time{}, false
+}
+
+func fingerprint(ev *Event) string {
+	h := fnv.New64a()
+	if ev.Params != nil {
+		h.Write(*ev.Params)
+	}
+	return fmt.Sprintf("%t/%s/%s/%x", ev.Inbound, ev.ID, ev.Method, h.Sum64())
+}
+
+// checkDuplicate warns when ev is identical to a request sent
+// less than --dup-window ago.
+func (b *Broker) checkDuplicate(ev *Event) {
+	if *dupWindow <= 0 || ev.Kind != EventKindRequest || ev.Status != EventStatusPending {
+		return
+	}
+
+	if b.RecentRequests == nil {
+		b.RecentRequests = newRecentRequests()
+	}
+
+	t := time.Now()
+	previous, ok := b.RecentRequests.Seen(fingerprint(ev), t)
+	if ok && t.Sub(previous) <= *dupWindow {
+		b.warn("duplicate request [%s] %s, identical to one sent %s ago", ev.ID, ev.Method, t.Sub(previous))
+	}
+}
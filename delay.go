@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// delayed reports whether --delay holds messages from the server
+// (inbound) or from the client.
+func delayed(inbound bool) bool {
+	if *delay <= 0 && *delayJitter <= 0 {
+		return false
+	}
+	return !(inbound && *delayDirection == "out") && !(!inbound && *delayDirection == "in")
+}
+
+// forwardDelay returns how long to hold a message from the server
+// (inbound) or from the client before forwarding it, with --delay.
+func forwardDelay(rng *rand.Rand, inbound bool) time.Duration {
+	if !delayed(inbound) {
+		return 0
+	}
+
+	d := *delay
+	if *delayJitter > 0 {
+		d += time.Duration(rng.Int63n(int64(*delayJitter)))
+	}
+	return d
+}
+
+type delayedMessage struct {
+	msg frame
+	due time.Time
+}
+
+// A delayLine holds the messages going one way with --delay or --rate.
+// Each one is released once its own delay has passed and --rate allows
+// it, in the order they came in, while the connection goes on with the
+// other direction.
+type delayLine struct {
+	in  chan delayedMessage
+	out chan frame
+
+	throttle throttle
+}
+
+func newDelayLine() *delayLine {
+	return &delayLine{
+		in:  make(chan delayedMessage),
+		out: make(chan frame),
+	}
+}
+
+// push queues msg to be released after d, unless ctx ends first.
+func (l *delayLine) push(ctx context.Context, msg frame, d time.Duration) {
+	select {
+	case l.in <- delayedMessage{msg, time.Now().Add(d)}:
+	case <-ctx.Done():
+	}
+}
+
+// close lets the line release what it holds, then close released.
+func (l *delayLine) close() {
+	close(l.in)
+}
+
+// released receives messages once they're due, or never for a nil line.
+func (l *delayLine) released() <-chan frame {
+	if l == nil {
+		return nil
+	}
+	return l.out
+}
+
+// run releases queued messages until ctx ends, or until it's closed
+// and has released them all.
+func (l *delayLine) run(ctx context.Context) {
+	in := l.in
+	var queue []delayedMessage
+	for {
+		if in == nil && len(queue) == 0 {
+			close(l.out)
+			return
+		}
+
+		// only one of them is set, while there's something queued
+		var due <-chan time.Time
+		var out chan frame
+		var next frame
+		if len(queue) > 0 {
+			if wait := time.Until(l.throttle.ready(queue[0].due)); wait > 0 {
+				due = time.After(wait)
+			} else {
+				out, next = l.out, queue[0].msg
+			}
+		}
+
+		select {
+		case m, ok := <-in:
+			if !ok {
+				in = nil
+				break
+			}
+			queue = append(queue, m)
+		case <-due:
+		case out <- next:
+			queue = queue[1:]
+			l.throttle.sent()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// canonicalJSON re-encodes msg with object keys sorted and no whitespace,
+// so that equivalent documents compare equal. Invalid JSON is returned as is.
+func canonicalJSON(msg *json.RawMessage) []byte {
+	if msg == nil {
+		return nil
+	}
+	value, ok := decodeJSON(*msg)
+	if !ok {
+		return *msg
+	}
+	canonical, err := json.Marshal(value)
+	must(err)
+	return canonical
+}
+
+func decodeJSON(input []byte) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	var value interface{}
+	if decoder.Decode(&value) != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// resultKey identifies repeated calls for --diff: same direction, same
+// method and same params, regardless of their formatting.
+func resultKey(ev *Event) string {
+	return fmt.Sprintf("%t/%s/%x", ev.Inbound, ev.Method, sha256.Sum256(canonicalJSON(ev.Params)))
+}
+
+// checkResultDiff compares the result of a completed request with the
+// result of the last identical call, with --diff, and remembers it for
+// the next one.
+func (b *Broker) checkResultDiff(ev *Event) {
+	if !*diffRepeated || ev.Stubbed {
+		return
+	}
+
+	if b.Results == nil {
+		b.Results = make(map[string]*json.RawMessage)
+	}
+
+	key := resultKey(ev)
+	previous, ok := b.Results[key]
+	b.Results[key] = ev.Result
+	if ok {
+		ev.resultDiff = diffResults(previous, ev.Result)
+	}
+}
+
+// diffResults describes how after differs from before, as a list of
+// changed paths in the syntax of --group-by.
+func diffResults(before *json.RawMessage, after *json.RawMessage) string {
+	if before == nil || after == nil {
+		if before == after {
+			return "≈ unchanged"
+		}
+		return fmt.Sprintf("Δ %s → %s", trimJSON(before), trimJSON(after))
+	}
+
+	beforeValue, beforeOK := decodeJSON(*before)
+	afterValue, afterOK := decodeJSON(*after)
+	if !beforeOK || !afterOK {
+		if bytes.Equal(*before, *after) {
+			return "≈ unchanged"
+		}
+		return fmt.Sprintf("Δ %s → %s", trimJSON(before), trimJSON(after))
+	}
+
+	var changes []string
+	diffValues("$", beforeValue, afterValue, &changes)
+	if len(changes) == 0 {
+		return "≈ unchanged"
+	}
+	return "Δ " + strings.Join(changes, ", ")
+}
+
+func diffValues(path string, before interface{}, after interface{}, changes *[]string) {
+	switch beforeValue := before.(type) {
+	case map[string]interface{}:
+		afterValue, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(beforeValue)+len(afterValue))
+		for key := range beforeValue {
+			keys = append(keys, key)
+		}
+		for key := range afterValue {
+			if _, ok := beforeValue[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffMember(path+"."+key, beforeValue, afterValue, key, changes)
+		}
+		return
+	case []interface{}:
+		afterValue, ok := after.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(beforeValue) || i < len(afterValue); i++ {
+			childPath := path + "." + strconv.Itoa(i)
+			switch {
+			case i >= len(afterValue):
+				*changes = append(*changes, "-"+childPath)
+			case i >= len(beforeValue):
+				*changes = append(*changes, fmt.Sprintf("+%s: %s", childPath, encodeValue(afterValue[i])))
+			default:
+				diffValues(childPath, beforeValue[i], afterValue[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, fmt.Sprintf("%s: %s → %s", path, encodeValue(before), encodeValue(after)))
+	}
+}
+
+func diffMember(path string, before map[string]interface{}, after map[string]interface{}, key string, changes *[]string) {
+	beforeValue, inBefore := before[key]
+	afterValue, inAfter := after[key]
+	switch {
+	case !inAfter:
+		*changes = append(*changes, "-"+path)
+	case !inBefore:
+		*changes = append(*changes, fmt.Sprintf("+%s: %s", path, encodeValue(afterValue)))
+	default:
+		diffValues(path, beforeValue, afterValue, changes)
+	}
+}
+
+func encodeValue(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	must(err)
+	return string(encoded)
+}
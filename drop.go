@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+)
+
+// connectionRand returns the randomness for --drop-rate and --delay-jitter
+// on a single connection. With --seed, every connection gets the same
+// sequence, so test runs drop and delay the same messages each time.
+func connectionRand() *rand.Rand {
+	seed := *randomSeed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// shouldDrop decides whether to drop the next message, with --drop-rate.
+func shouldDrop(rng *rand.Rand) bool {
+	return *dropRate > 0 && rng.Float64() < *dropRate
+}
+
+// droppedEvent returns an event for msgString, which --drop-rate kept from
+// being forwarded. A dropped reply doesn't complete its request: as far as
+// the recipient knows, it's still pending.
+func (b *Broker) droppedEvent(inbound bool, msgString string) *Event {
+	at := now()
+	ev := &Event{
+		Start:   at,
+		End:     at,
+		Kind:    EventKindMalformed,
+		Inbound: inbound,
+		Raw:     msgString,
+		Size:    len(msgString),
+		Status:  EventStatusDropped,
+	}
+
+	var msg RpcMessage
+	if json.Unmarshal([]byte(msgString), &msg) != nil {
+		return ev
+	}
+	ev.ID = msg.ID
+	ev.Method = msg.Method
+	ev.Params = msg.Params
+	ev.Result = msg.Result
+	ev.Error = msg.Error
+
+	ev.Kind = EventKindNotification
+	if msg.ID != "" {
+		ev.Kind = EventKindRequest
+		if req := b.GetRequest(!inbound, msg.ID); msg.Method == "" && req != nil {
+			ev.Method = req.Method
+		}
+	}
+	return ev
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// how many of each broker's latest events go in a dump
+const dumpRecentEvents = 50
+
+// BrokerSnapshot is a copy of a broker's state, safe to use
+// while its connection keeps going.
+type BrokerSnapshot struct {
+	Name             string    `json:"name"`
+	ConnectedAt      time.Time `json:"connectedAt"`
+	LastActivity     time.Time `json:"lastActivity"`
+	TotalEvents      int       `json:"totalEvents"`
+	InboundRequests  []Event   `json:"inboundRequests"`
+	OutboundRequests []Event   `json:"outboundRequests"`
+	RecentEvents     []Event   `json:"recentEvents"`
+}
+
+// Snapshot copies the broker's pending requests and its latest events.
+func (b *Broker) Snapshot(recent int) BrokerSnapshot {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	snap := BrokerSnapshot{
+		Name:             b.Name,
+		ConnectedAt:      b.ConnectedAt,
+		LastActivity:     b.LastActivity,
+		TotalEvents:      len(b.Events),
+		InboundRequests:  []Event{},
+		OutboundRequests: []Event{},
+		RecentEvents:     []Event{},
+	}
+	for _, ev := range b.InboundRequests {
+		snap.InboundRequests = append(snap.InboundRequests, *ev)
+	}
+	for _, ev := range b.OutboundRequests {
+		snap.OutboundRequests = append(snap.OutboundRequests, *ev)
+	}
+
+	events := b.Events
+	if len(events) > recent {
+		events = events[len(events)-recent:]
+	}
+	for _, ev := range events {
+		snap.RecentEvents = append(snap.RecentEvents, *ev)
+	}
+	return snap
+}
+
+// dumpBrokers writes a snapshot of every live broker to a new file in dir
+// and returns its path.
+func dumpBrokers(dir string) (string, error) {
+	snaps := []BrokerSnapshot{}
+	for _, b := range registry.Snapshot() {
+		snaps = append(snaps, b.Snapshot(dumpRecentEvents))
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].ConnectedAt.Before(snaps[j].ConnectedAt)
+	})
+
+	payload, err := json.MarshalIndent(snaps, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("teacup-state-%s.json", time.Now().UTC().Format("20060102-150405.000")))
+	err = ioutil.WriteFile(path, payload, 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// there's no SIGUSR1 here, use the 'dump' control command instead
+func notifyDump(c chan<- os.Signal) {}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
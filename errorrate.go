@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+var alertColor = color.New(color.FgHiRed, color.Bold)
+
+// alert prints something that needs the operator's attention,
+// in a color that stands out from every broker's.
+func (b *Broker) alert(format string, args ...interface{}) {
+	sink.Note(b, "‼", alertColor, fmt.Sprintf(format, args...))
+}
+
+// trackErrorRate remembers when errors happened over the last
+// --error-rate-window, and alerts once when there are too many.
+func (b *Broker) trackErrorRate() {
+	t := time.Now()
+	cutoff := t.Add(-*errorRateWindow)
+	recent := b.RecentErrors[:0]
+	for _, errTime := range b.RecentErrors {
+		if errTime.After(cutoff) {
+			recent = append(recent, errTime)
+		}
+	}
+	b.RecentErrors = append(recent, t)
+
+	if *errorRateAlert <= 0 {
+		return
+	}
+
+	if len(b.RecentErrors) < *errorRateAlert {
+		b.ErrorRateAlerted = false
+		return
+	}
+
+	if !b.ErrorRateAlerted {
+		b.ErrorRateAlerted = true
+		b.alert("%d errors in the last %s", len(b.RecentErrors), *errorRateWindow)
+	}
+}
+
+// recentErrors returns how many errors happened within the last
+// --error-rate-window.
+func (b *Broker) recentErrors() int {
+	cutoff := time.Now().Add(-*errorRateWindow)
+	count := 0
+	for _, errTime := range b.RecentErrors {
+		if errTime.After(cutoff) {
+			count++
+		}
+	}
+	return count
+}
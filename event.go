@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
 )
 
-type PendingRequests map[int64]*Event
+type PendingRequests map[RpcID]*Event
 
 var colors = []color.Attribute{
 	color.FgWhite,
@@ -26,23 +34,92 @@ var colors = []color.Attribute{
 	color.FgHiMagenta,
 }
 
+// A Broker tracks the traffic of a single connection. Its state is mostly
+// modified from that connection's goroutine, always with mu held. Other
+// goroutines must hold mu, at least for reading, to read it. Exported
+// methods take care of locking, except for Landed, Updated, MarkIdle,
+// Render and Delta, which expect mu held.
 type Broker struct {
+	mu sync.RWMutex
+
 	Name             string
 	InboundRequests  PendingRequests
 	OutboundRequests PendingRequests
 	Events           []*Event
 	Color            *color.Color
-	LastActivity     time.Time
+	ColorAttr        color.Attribute
+	// when the broker last saw traffic, printed or not
+	LastActivity time.Time
+	// when the broker last printed a line, for Delta
+	lastPrinted time.Time
+
+	// set by Retire, which only does anything the first time
+	retired bool
+
+	// when the client connected to teacup, as a stable time origin
+	// for the connection
+	ConnectedAt time.Time
+
+	// how many steps of expectedSequence this broker has gone through
+	SequenceStep int
+
+	// when --log-dir is set, receives every event transition
+	LogFile *os.File
+
+	// how many requests errored
+	Errors int
+
+	// when errors happened, for --error-rate-alert
+	RecentErrors     []time.Time
+	ErrorRateAlerted bool
+
+	// traffic per --group-by key
+	Groups map[string]*GroupStats
+
+	// fingerprints of recent requests, for --dup-window
+	RecentRequests *RecentRequests
+
+	// latest streak of identical errors, for --collapse-errors
+	ErrorRun *ErrorRun
+
+	// request latencies per method, for --stats
+	Methods map[string]*MethodStats
+
+	// latest result of each distinct call, for --diff
+	Results map[string]*json.RawMessage
+}
+
+// brokerColor picks the color for a broker named name: always the same
+// one for the same name, so reconnecting to a server keeps its color,
+// unless --random-colors.
+func brokerColor(name string) color.Attribute {
+	if *randomColors {
+		return colors[rand.Intn(len(colors))]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return colors[h.Sum32()%uint32(len(colors))]
 }
 
-func newBroker(name string) *Broker {
-	return &Broker{
+func newBroker(name string, connectedAt time.Time) *Broker {
+	attr := brokerColor(name)
+	recordPalette(name, attr)
+
+	b := &Broker{
 		Name:             name,
 		InboundRequests:  make(PendingRequests),
 		OutboundRequests: make(PendingRequests),
-		Color:            color.New(colors[rand.Intn(len(colors))]),
+		Color:            color.New(attr),
+		ColorAttr:        attr,
 		LastActivity:     time.Now().UTC(),
+		lastPrinted:      time.Now().UTC(),
+		ConnectedAt:      connectedAt,
+	}
+	if *logDir != "" {
+		b.LogFile = openBrokerLog(*logDir, name)
 	}
+	registry.Add(b)
+	return b
 }
 
 func now() *time.Time {
@@ -50,24 +127,99 @@ func now() *time.Time {
 	return &t
 }
 
-func (b *Broker) GetRequest(inbound bool, id int64) *Event {
+// GetRequest returns the pending request with the given id. Failing an
+// exact match, an id with the same value does: "1" for 1, or 1 for "1".
+// --check-ids warns about those.
+func (b *Broker) GetRequest(inbound bool, id RpcID) *Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	requests := b.OutboundRequests
 	if inbound {
-		return b.InboundRequests[id]
-	} else {
-		return b.OutboundRequests[id]
+		requests = b.InboundRequests
+	}
+	if req := requests[id]; req != nil {
+		return req
 	}
+
+	value := id.value()
+	for _, req := range requests {
+		if req.ID.value() == value {
+			return req
+		}
+	}
+	return nil
+}
+
+// OldestRequest returns the pending request that was sent first, among
+// those with the given method if it's not empty.
+func (b *Broker) OldestRequest(inbound bool, method string) *Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	requests := b.OutboundRequests
+	if inbound {
+		requests = b.InboundRequests
+	}
+
+	var oldest *Event
+	for _, req := range requests {
+		if method != "" && req.Method != method {
+			continue
+		}
+		if oldest == nil || req.Start.Before(*oldest.Start) {
+			oldest = req
+		}
+	}
+	return oldest
+}
+
+// Counts returns how many events the broker has seen, and how many
+// requests are pending.
+func (b *Broker) Counts() (events int, pending int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.Events), len(b.InboundRequests) + len(b.OutboundRequests)
+}
+
+// Pending returns how many requests from the client (outbound) and from
+// the server (inbound) are awaiting a reply.
+func (b *Broker) Pending() (outbound int, inbound int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.OutboundRequests), len(b.InboundRequests)
 }
 
 func (b *Broker) Retire() {
+	registry.Remove(b)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.retired {
+		// shutdown may race the connection's own cleanup to it
+		return
+	}
+	b.retired = true
+
+	defer b.endErrorRun()
+	defer b.reportGroups()
+	defer b.reportMethods()
+	defer b.reportSequence()
+
 	for _, req := range b.InboundRequests {
-		req.RecordCancellation()
+		req.recordCancellation()
 	}
 	for _, req := range b.OutboundRequests {
-		req.RecordCancellation()
+		req.recordCancellation()
 	}
+	b.closeLog()
 }
 
 func (b *Broker) Landed(ev *Event) {
+	ev.hangAlerted = false
+	if ev.timeout != nil {
+		ev.timeout.Stop()
+	}
 	if ev.Inbound {
 		delete(b.InboundRequests, ev.ID)
 	} else {
@@ -76,21 +228,195 @@ func (b *Broker) Landed(ev *Event) {
 }
 
 func (b *Broker) Updated(ev *Event) {
+	b.writeLog(ev)
+	b.countGroup(ev)
+	b.countMethod(ev)
+
+	// on traffic rather than on printing, so that hidden events and
+	// --format json keep the broker active too
+	if *gapMarker > 0 && time.Since(b.LastActivity) > *gapMarker {
+		b.MarkIdle()
+	}
+	b.LastActivity = time.Now().UTC()
+
 	if !b.ShouldPrint(ev) {
 		return
 	}
 
-	spacer := strings.Repeat("  ", len(b.InboundRequests)+len(b.OutboundRequests))
-	arrow := "→"
+	sink.Event(b, ev)
+	b.refreshStatus()
+}
+
+// EventLine holds everything an --output-template can refer to.
+type EventLine struct {
+	// with --timestamps, when the event started and a space
+	Time    string
+	Delta   string
+	Indent  string
+	Arrow   string
+	Broker  string
+	Summary string
+	Group   string
+
+	ID       RpcID
+	Method   string
+	Kind     EventKind
+	Status   EventStatus
+	Duration time.Duration
+	Inbound  bool
+	Params   string
+	Result   string
+	Error    string
+	// in bytes, 0 if unknown
+	Size      int
+	ReplySize int
+}
+
+const defaultLineFormat = "{{.Time}}{{.Delta}}{{.Indent}}{{.Arrow}} {{.Broker}} {{.Summary}}"
+
+var lineTemplate = template.Must(template.New("line").Parse(defaultLineFormat))
+
+// Render formats ev as a single line, using lineTemplate.
+func (b *Broker) Render(ev *Event) string {
+	line := EventLine{
+		Time:    timestamp(*ev.Start),
+		Delta:   b.Delta(),
+		Indent:  depthMark(len(b.InboundRequests) + len(b.OutboundRequests)),
+		Arrow:   "→",
+		Broker:  pad("broker", b.Name, maxBrokerWidth),
+		Summary: ev.String(),
+		Group:   ev.Group,
+
+		ID:       ev.ID,
+		Method:   ev.Method,
+		Kind:     ev.Kind,
+		Status:   ev.Status,
+		Duration: ev.Duration(),
+		Inbound:  ev.Inbound,
+		Params:   trimJSON(ev.Params),
+		Result:   trimJSON(ev.Result),
+
+		Size:      ev.Size,
+		ReplySize: ev.ReplySize,
+	}
 	if ev.Inbound {
-		arrow = "←"
+		line.Arrow = "←"
+	}
+	if *groupPrefix && ev.Group != "" {
+		line.Summary = fmt.Sprintf("[%s] %s", ev.Group, line.Summary)
+	}
+	if ev.Error != nil {
+		line.Error = trim(ev.Error.Message)
+	}
+
+	var buf bytes.Buffer
+	err := lineTemplate.Execute(&buf, line)
+	if err != nil {
+		return fmt.Sprintf("%s (format error: %s)", line.Summary, err)
 	}
-	b.Color.Printf("%s%s%s %s %s\n", b.Delta(), spacer, arrow, b.Name, ev)
+
+	if body := ev.body(); *prettyJSON && body != nil && json.Valid(*body) {
+		// beneath the header, lined up with the summary
+		prefix := strings.Repeat(" ", line.summaryColumn())
+		buf.WriteString("\n" + prefix)
+		must(json.Indent(&buf, *body, prefix, "  "))
+	}
+	return buf.String()
+}
+
+// summaryColumn returns how many columns come before the summary when
+// line is printed with lineTemplate, or 0 if the template doesn't show it.
+func (line EventLine) summaryColumn() int {
+	const mark = "\x00"
+	line.Summary = mark
+
+	var buf bytes.Buffer
+	if lineTemplate.Execute(&buf, line) != nil {
+		return 0
+	}
+	header := buf.String()
+	i := strings.Index(header, mark)
+	if i < 0 {
+		return 0
+	}
+	header = header[:i]
+	return utf8.RuneCountInString(header[strings.LastIndex(header, "\n")+1:])
+}
+
+// MarkIdle records the time since the broker's last activity as an
+// explicit idle event, so long pauses show up in the timeline.
+func (b *Broker) MarkIdle() {
+	start := b.LastActivity
+	ev := &Event{
+		Broker: b,
+		Start:  &start,
+		End:    now(),
+		Kind:   EventKindIdle,
+		Status: EventStatusCompleted,
+	}
+	b.Events = append(b.Events, ev)
+	b.writeLog(ev)
+	sink.Event(b, ev)
+}
+
+// Announce prints a line about the traffic seen by this broker
+// that isn't tied to a single event.
+func (b *Broker) Announce(glyph string, format string, args ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.announce(glyph, format, args...)
+}
+
+func (b *Broker) announce(glyph string, format string, args ...interface{}) {
+	sink.Note(b, glyph, b.Color, fmt.Sprintf(format, args...))
+}
+
+// Warn announces something suspicious about the traffic.
+func (b *Broker) Warn(format string, args ...interface{}) {
+	b.Announce("⚠", format, args...)
+}
+
+func (b *Broker) warn(format string, args ...interface{}) {
+	b.announce("⚠", format, args...)
+}
+
+// timestamp returns t and a space to start a line with, or "" without
+// --timestamps.
+func timestamp(t time.Time) string {
+	if !*timestamps {
+		return ""
+	}
+	return t.Format(*timeFormat) + " "
+}
+
+// globalActivity is when any broker last printed something, for
+// --global-clock.
+var globalActivity struct {
+	sync.Mutex
+	last time.Time
 }
 
+// Delta returns how long it's been since the broker's previous line, or
+// any broker's with --global-clock, formatted to start a new line.
 func (b *Broker) Delta() string {
+	if *sinceConnect {
+		b.lastPrinted = time.Now().UTC()
+		return fmt.Sprintf("%10s ", fmt.Sprintf("%.3f s", time.Since(b.ConnectedAt).Seconds()))
+	}
+
+	now := time.Now().UTC()
+	last := b.lastPrinted
+	if *globalClock {
+		globalActivity.Lock()
+		if !globalActivity.last.IsZero() {
+			last = globalActivity.last
+		}
+		globalActivity.last = now
+		globalActivity.Unlock()
+	}
+
 	s := ""
-	d := time.Since(b.LastActivity)
+	d := now.Sub(last)
 	if d < 1*time.Millisecond {
 		// nothing
 	} else if d.Seconds() < 1.0 {
@@ -102,35 +428,113 @@ func (b *Broker) Delta() string {
 	}
 
 	res := fmt.Sprintf("%10v ", s)
-	b.LastActivity = time.Now().UTC()
+	b.lastPrinted = now
 	return res
 }
 
+// events whose method contains any of these aren't printed
 var bannedMethods = []string{
 	// "Meta.Authenticate",
 	"Fetch.Commons",
 	"Profile.Data",
 }
 
+// muteMethods adds methods to bannedMethods, from --mute and from the
+// --mute-file at path, which has one method per line. Blank lines and
+// lines starting with '#' are skipped.
+func muteMethods(methods []string, path string) error {
+	bannedMethods = append(bannedMethods, methods...)
+	if path == "" {
+		return nil
+	}
+
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bannedMethods = append(bannedMethods, line)
+	}
+	return nil
+}
+
+// compiled --mute-regex and --only-regex patterns
+var mutedPatterns, onlyPatterns []*regexp.Regexp
+
+// matchesAny reports whether method contains any of substrings,
+// or matches any of patterns.
+func matchesAny(method string, substrings []string, patterns []*regexp.Regexp) bool {
+	for _, s := range substrings {
+		if strings.Contains(method, s) {
+			return true
+		}
+	}
+	for _, p := range patterns {
+		if p.MatchString(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusShown returns whether --status lets events with status through.
+func statusShown(status EventStatus) bool {
+	if len(*statuses) == 0 {
+		return true
+	}
+	for _, s := range *statuses {
+		if s == string(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldPrint reports whether ev goes the way --direction asks, has a
+// status --status lets through, and has a method that matches one of the
+// --only rules, if there are any, and none of the muted ones.
 func (b *Broker) ShouldPrint(ev *Event) bool {
-	for _, banned := range bannedMethods {
-		if strings.Contains(ev.Method, banned) {
+	if (*direction == "in" && !ev.Inbound) || (*direction == "out" && ev.Inbound) {
+		return false
+	}
+	// checked at each transition, so a request filtered out while pending
+	// can still be printed once it completes or errors
+	if !statusShown(ev.Status) {
+		return false
+	}
+	if ev.Kind == EventKindMalformed {
+		// has no method to filter by, and is always worth seeing
+		return true
+	}
+	if len(*only) > 0 || len(onlyPatterns) > 0 {
+		if !matchesAny(ev.Method, *only, onlyPatterns) {
 			return false
 		}
 	}
-	return true
+	return !matchesAny(ev.Method, bannedMethods, mutedPatterns)
 }
 
 type Event struct {
-	Broker *Broker
+	Broker *Broker `json:"-"`
 
-	ID     int64      `json:"id"`
+	ID     RpcID      `json:"id,omitempty"`
 	Method string     `json:"method"`
 	Start  *time.Time `json:"start"`
 	End    *time.Time `json:"end"`
 	Kind   EventKind  `json:"kind"`
 	Raw    string     `json:"raw"`
 
+	// the reply to a request, exactly as it was received
+	RawReply string `json:"rawReply,omitempty"`
+
+	// size in bytes of the message, and of the reply to a request
+	Size      int `json:"size,omitempty"`
+	ReplySize int `json:"replySize,omitempty"`
+
 	// When true, is a request/notif sent by the server to the client.
 	// They're both peers, but conceptually teacup thinks of one as a server still.
 	Inbound bool `json:"inbound"`
@@ -139,46 +543,143 @@ type Event struct {
 	Error  *RpcError        `json:"error"`
 	Params *json.RawMessage `json:"params"`
 	Result *json.RawMessage `json:"result"`
+
+	// value of the --group-by key, if any
+	Group string `json:"group,omitempty"`
+
+	// how long the client said the request may take, with --deadline-field
+	Deadline         time.Duration `json:"deadline,omitempty"`
+	DeadlineExceeded bool          `json:"deadlineExceeded,omitempty"`
+
+	// answered by teacup itself, with --stub
+	Stubbed bool `json:"stubbed,omitempty"`
+
+	// id exactly as it was sent, to check the reply reflects it
+	rawID []byte
+
+	// whether --hang-alert went off for this request while it was pending
+	hangAlerted bool
+	// how many multiples of --slow-threshold it was warned about
+	slowWarnings int
+	// with --diff, how the result differs from the last identical call's
+	resultDiff string
+	// with --request-timeout, fires unless the request lands first
+	timeout *time.Timer
 }
 
 func (ev *Event) AddTo(b *Broker) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	requests := b.OutboundRequests
+	if ev.Inbound {
+		requests = b.InboundRequests
+	}
+
+	// orphan replies are requests too, but there's nothing to wait for
+	pending := ev.Kind == EventKindRequest && ev.Status == EventStatusPending
+
+	if pending {
+		if previous := requests[ev.ID]; previous != nil {
+			// the reply can't be told apart, assume it's for the latest
+			b.warn("[%s] %s reuses the id of a pending %s request, which won't be matched to a reply anymore",
+				ev.ID, ev.Method, previous.Method)
+			previous.recordCancellation()
+		}
+	}
+
 	ev.Broker = b
+	eventsByKind.Add(string(ev.Kind), 1)
+	countEvent(ev)
 	b.Updated(ev)
+	b.checkSequence(ev)
+	b.checkDuplicate(ev)
 
 	b.Events = append(b.Events, ev)
-	if ev.Kind == EventKindRequest {
-		if ev.Inbound {
-			b.InboundRequests[ev.ID] = ev
-		} else {
-			b.OutboundRequests[ev.ID] = ev
-		}
+	if pending {
+		trackRequest(ev)
+		requests[ev.ID] = ev
 	}
+	b.refreshStatus()
 	return time.Now().UTC()
 }
 
 func (ev *Event) RecordCompletion(result *json.RawMessage) {
+	ev.Broker.mu.Lock()
+	defer ev.Broker.mu.Unlock()
+	ev.recordCompletion(result)
+}
+
+// RecordStub completes a request with the result teacup sent for it,
+// with --stub.
+func (ev *Event) RecordStub(result *json.RawMessage) {
+	ev.Broker.mu.Lock()
+	defer ev.Broker.mu.Unlock()
+	ev.Stubbed = true
+	ev.recordCompletion(result)
+}
+
+func (ev *Event) recordCompletion(result *json.RawMessage) {
 	ev.End = now()
 	ev.Result = result
 	ev.Status = EventStatusCompleted
+	ev.checkDeadline()
+	trackAnswer(ev)
+	observeDuration(ev)
 
 	b := ev.Broker
+	b.checkResultDiff(ev)
 	b.Landed(ev)
 	b.Updated(ev)
 }
 
+// RecordReply completes a request with the reply msg, which was received
+// as raw.
+func (ev *Event) RecordReply(msg *RpcMessage, raw string) {
+	ev.Broker.mu.Lock()
+	defer ev.Broker.mu.Unlock()
+
+	ev.RawReply = raw
+	ev.ReplySize = len(raw)
+	if msg.Error != nil {
+		ev.recordError(msg.Error)
+		return
+	}
+	ev.recordCompletion(msg.Result)
+}
+
 func (ev *Event) RecordError(err *RpcError) {
+	ev.Broker.mu.Lock()
+	defer ev.Broker.mu.Unlock()
+	ev.recordError(err)
+}
+
+func (ev *Event) recordError(err *RpcError) {
 	ev.End = now()
 	ev.Error = err
 	ev.Status = EventStatusErrored
+	ev.checkDeadline()
+	trackAnswer(ev)
+	observeDuration(ev)
 
 	b := ev.Broker
+	b.Errors++
+	requestErrors.Add(1)
 	b.Landed(ev)
 	b.Updated(ev)
+	b.trackErrorRate()
 }
 
 func (ev *Event) RecordCancellation() {
+	ev.Broker.mu.Lock()
+	defer ev.Broker.mu.Unlock()
+	ev.recordCancellation()
+}
+
+func (ev *Event) recordCancellation() {
 	ev.End = now()
 	ev.Status = EventStatusCancelled
+	observeDuration(ev)
 
 	b := ev.Broker
 	b.Landed(ev)
@@ -194,48 +695,114 @@ func (ev *Event) Duration() time.Duration {
 		return time.Duration(0)
 	case EventKindNotification:
 		return time.Duration(0)
+	case EventKindIdle:
+		return ev.End.Sub(*ev.Start)
+	case EventKindMalformed:
+		return time.Duration(0)
 	}
 	panic(fmt.Sprintf("Invalid event kind %s", ev.Kind))
 }
 
+// trim shortens s to --max-width bytes, if it's longer.
 func trim(s string) string {
-	if len(s) > 60 {
-		return s[:60] + "..."
+	width := *maxWidth
+	if width > 0 && len(s) > width {
+		suffix := *ellipsis
+		if *ellipsisCount {
+			suffix += fmt.Sprintf("(+%d bytes)", len(s)-width)
+		}
+		return s[:width] + suffix
 	}
 	return s
 }
 
+// body returns the params or result that ev shows, if any.
+func (ev *Event) body() *json.RawMessage {
+	switch ev.Kind {
+	case EventKindRequest:
+		switch ev.Status {
+		case EventStatusPending:
+			return ev.Params
+		case EventStatusCompleted, EventStatusOrphan:
+			if ev.resultDiff != "" {
+				return nil
+			}
+			return ev.Result
+		}
+	case EventKindNotification:
+		if _, ok := notificationFormatters[ev.Method]; !ok {
+			return ev.Params
+		}
+	}
+	return nil
+}
+
+// inlineJSON is trimJSON, except with --pretty-json, where valid JSON is
+// shown beneath the event's line by Render instead.
+func inlineJSON(msg *json.RawMessage) string {
+	if *prettyJSON && msg != nil && json.Valid(*msg) {
+		return ""
+	}
+	return trimJSON(msg)
+}
+
 func trimJSON(msg *json.RawMessage) string {
 	if msg == nil {
 		return "Ø"
 	}
 	bs := []byte(*msg)
+	if bytes.ContainsAny(bs, "\r\n") {
+		// pretty-printed, which only framings other than lines allow
+		bs = compactJSON(bs)
+	}
 	return trim(string(bs))
 }
 
 func (ev *Event) String() string {
+	if ev.Status == EventStatusDropped {
+		what := "dropped"
+		if ev.Kind == EventKindRequest && (ev.Result != nil || ev.Error != nil) {
+			what = "reply dropped"
+		}
+		return fmt.Sprintf("✂ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(formatSize(ev.Size)), what)
+	}
+
 	switch ev.Kind {
 	case EventKindRequest:
 		switch ev.Status {
 		case EventStatusPending:
-			return fmt.Sprintf("• [%d] %s %s", ev.ID, ev.Method, trimJSON(ev.Params))
+			return strings.TrimSpace(fmt.Sprintf("• %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(formatSize(ev.Size)), inlineJSON(ev.Params)))
 		case EventStatusCompleted:
-			return fmt.Sprintf("✔ [%d] %s (%s) %s", ev.ID, ev.Method, ev.Duration(), trimJSON(ev.Result))
+			if ev.Stubbed {
+				return strings.TrimSpace(fmt.Sprintf("✎ %s %s (stub) %s", ev.idColumn(), ev.methodColumn(), inlineJSON(ev.Result)))
+			}
+			if ev.resultDiff != "" {
+				return fmt.Sprintf("✔ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(ev.timing(), formatSize(ev.ReplySize)), trim(ev.resultDiff))
+			}
+			return strings.TrimSpace(fmt.Sprintf("✔ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(ev.timing(), formatSize(ev.ReplySize)), inlineJSON(ev.Result)))
 		case EventStatusErrored:
-			return fmt.Sprintf("✕ [%d] %s (%s) %s", ev.ID, ev.Method, ev.Duration(), trim(ev.Error.Message))
+			return fmt.Sprintf("✕ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(ev.timing(), formatSize(ev.ReplySize)), trim(ev.Error.Message))
 		case EventStatusCancelled:
-			return fmt.Sprintf("⚐ [%d] %s (%s)", ev.ID, ev.Method, ev.Duration())
+			return fmt.Sprintf("⚐ %s %s (%s)", ev.idColumn(), ev.methodColumn(), ev.Duration())
+		case EventStatusOrphan:
+			if ev.Error != nil {
+				return fmt.Sprintf("⚠ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(formatSize(ev.Size)), trim(ev.Error.Message))
+			}
+			return strings.TrimSpace(fmt.Sprintf("⚠ %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(formatSize(ev.Size)), inlineJSON(ev.Result)))
 		}
 	case EventKindNotification:
-		if ev.Method == "Log" {
-			var msg = struct {
-				Level   string `json:"level"`
-				Message string `json:"message"`
-			}{}
-			json.Unmarshal(*ev.Params, &msg)
-			return fmt.Sprintf("# %s", msg.Message)
+		if format, ok := notificationFormatters[ev.Method]; ok {
+			line, _ := format(ev.Params)
+			return line
+		}
+		return strings.TrimSpace(fmt.Sprintf("- %s %s%s %s", ev.idColumn(), ev.methodColumn(), parenthesized(formatSize(ev.Size)), inlineJSON(ev.Params)))
+	case EventKindIdle:
+		return fmt.Sprintf("… idle %s", ev.Duration())
+	case EventKindMalformed:
+		if ev.Error != nil {
+			return fmt.Sprintf("✕ malformed %s", trim(ev.Error.Message))
 		}
-		return fmt.Sprintf("- %s %s", ev.Method, trimJSON(ev.Params))
+		return fmt.Sprintf("⚠ malformed%s %s", parenthesized(formatSize(ev.Size)), trim(ev.Raw))
 	}
 	panic(fmt.Sprintf("Invalid event kind %s", ev.Kind))
 }
@@ -245,6 +812,9 @@ type EventKind string
 const (
 	EventKindRequest      EventKind = "request"
 	EventKindNotification EventKind = "notification"
+	EventKindIdle         EventKind = "idle"
+	// a message that isn't valid JSON, forwarded all the same
+	EventKindMalformed EventKind = "malformed"
 )
 
 type EventStatus string
@@ -254,4 +824,8 @@ const (
 	EventStatusCompleted EventStatus = "completed"
 	EventStatusErrored   EventStatus = "errored"
 	EventStatusCancelled EventStatus = "cancelled"
+	// a reply to a request teacup never saw
+	EventStatusOrphan EventStatus = "orphan"
+	// not forwarded, because of --drop-rate
+	EventStatusDropped EventStatus = "dropped"
 )
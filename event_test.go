@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBrokerIsSafeToRead records traffic on a broker while the status
+// page, dumps, --slow-threshold and metrics read it, for go test -race.
+func TestBrokerIsSafeToRead(t *testing.T) {
+	parseFlags(t,
+		"--diff",
+		"--stats",
+		"--group-by", "$.params.tenant",
+		"--metrics-addr", "127.0.0.1:0",
+	)
+
+	b := newBroker("race", time.Now().UTC())
+	defer b.Retire()
+
+	result := json.RawMessage(`{"ok":true}`)
+	params := json.RawMessage(`{"tenant":"a"}`)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b.Status()
+			b.Snapshot(10)
+			b.CheckSlow(time.Nanosecond)
+			b.Pending()
+			for _, live := range registry.Snapshot() {
+				live.Counts()
+			}
+			writeMetrics(ioutil.Discard)
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		ev := &Event{
+			Start:   now(),
+			ID:      NumericID(int64(i)),
+			Kind:    EventKindRequest,
+			Method:  "Game.Fetch",
+			Inbound: i%2 == 0,
+			Params:  &params,
+			Status:  EventStatusPending,
+		}
+		ev.AddTo(b)
+		if i%3 == 0 {
+			ev.RecordCancellation()
+		} else {
+			ev.RecordReply(&RpcMessage{ID: ev.ID, Result: &result}, `{"id":`+string(ev.ID)+`,"result":{"ok":true}}`)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	outbound, inbound := b.Pending()
+	if outbound != 0 || inbound != 0 {
+		t.Errorf("%d outbound and %d inbound requests still pending", outbound, inbound)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// LoggedEvent is an event as written to logs, along with the time its
+// connection was accepted, to correlate captures across machines.
+type LoggedEvent struct {
+	*Event
+	Connection  string    `json:"connection"`
+	Color       string    `json:"color,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	DurationMs  float64   `json:"durationMs,omitempty"`
+}
+
+// record is the file all connections' events go to, with --record.
+var record struct {
+	sync.Mutex
+	file *os.File
+}
+
+// openRecord creates the --record file, once, in start().
+func openRecord(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	record.file = f
+	return nil
+}
+
+func writeRecord(payload []byte) {
+	record.Lock()
+	defer record.Unlock()
+
+	// files aren't buffered, so it's on disk as soon as this returns
+	_, err := record.file.Write(payload)
+	if err != nil {
+		log.Printf("While writing to %s: %+v", record.file.Name(), err)
+	}
+}
+
+func (b *Broker) loggedEvent(ev *Event) LoggedEvent {
+	return LoggedEvent{
+		Event:       ev,
+		Connection:  b.Name,
+		Color:       colorNames[b.ColorAttr],
+		ConnectedAt: b.ConnectedAt,
+		DurationMs:  ev.Duration().Seconds() * 1000,
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// openBrokerLog creates the per-connection log file for a broker in dir.
+func openBrokerLog(dir string, name string) *os.File {
+	safeName := unsafeFileChars.ReplaceAllString(name, "")
+	fileName := fmt.Sprintf("%s-%s.ndjson", time.Now().UTC().Format("20060102-150405.000000"), safeName)
+
+	f, err := os.Create(filepath.Join(dir, fileName))
+	if err != nil {
+		log.Printf("While creating log for %s: %+v", name, err)
+		return nil
+	}
+	return f
+}
+
+// writeLog appends ev to the broker's log file, if it has one,
+// and to the --record file.
+func (b *Broker) writeLog(ev *Event) {
+	if b.LogFile == nil && record.file == nil {
+		return
+	}
+
+	// requests are updated in place, so in paired mode, the record
+	// written when they land already has both params and result.
+	if *logPaired && ev.Kind == EventKindRequest && ev.Status == EventStatusPending {
+		return
+	}
+
+	payload, err := json.Marshal(b.loggedEvent(ev))
+	must(err)
+	payload = append(payload, '\n')
+
+	if record.file != nil {
+		writeRecord(payload)
+	}
+	if b.LogFile == nil {
+		return
+	}
+
+	_, err = b.LogFile.Write(payload)
+	if err != nil {
+		log.Printf("While writing to %s: %+v", b.LogFile.Name(), err)
+	}
+}
+
+func (b *Broker) closeLog() {
+	if b.LogFile == nil {
+		return
+	}
+
+	err := b.LogFile.Close()
+	if err != nil {
+		log.Printf("While closing %s: %+v", b.LogFile.Name(), err)
+	}
+	b.LogFile = nil
+}
+
+// syncRecord makes sure everything written to the --record file is on
+// disk, before teacup exits.
+func syncRecord() {
+	record.Lock()
+	defer record.Unlock()
+
+	if record.file == nil {
+		return
+	}
+	err := record.file.Sync()
+	if err != nil {
+		log.Printf("While syncing %s: %+v", record.file.Name(), err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// A NotificationFormatter renders the params of a notification as a
+// single line, in place of the generic "- method params" rendering, and
+// picks the color to print it in, or nil for the broker's. params may
+// be nil.
+type NotificationFormatter func(params *json.RawMessage) (string, *color.Color)
+
+// notificationFormatters maps method names to how their notifications
+// are printed. Support for another server's notifications can be added
+// with registerFormatter, from an init function in a file of its own,
+// like the built-in ones below.
+var notificationFormatters = map[string]NotificationFormatter{}
+
+func init() {
+	registerFormatter("Log", formatLog)
+}
+
+// registerFormatter makes notifications for method print with format,
+// replacing any formatter it had.
+func registerFormatter(method string, format NotificationFormatter) {
+	notificationFormatters[method] = format
+}
+
+// logMessage returns the level and message of a Log notification.
+func logMessage(params *json.RawMessage) (string, string) {
+	var msg = struct {
+		Level   string `json:"level"`
+		Message string `json:"message"`
+	}{}
+	if params != nil {
+		json.Unmarshal(*params, &msg)
+	}
+	return msg.Level, msg.Message
+}
+
+// colors of Log notifications by level, instead of the broker's
+var logLevelColors = map[string]*color.Color{
+	"fatal":   color.New(color.FgRed, color.Bold),
+	"error":   color.New(color.FgRed),
+	"warn":    color.New(color.FgYellow),
+	"warning": color.New(color.FgYellow),
+	"debug":   color.New(color.Faint),
+	"trace":   color.New(color.Faint),
+}
+
+func formatLog(params *json.RawMessage) (string, *color.Color) {
+	level, message := logMessage(params)
+	return fmt.Sprintf("# %s", message), logLevelColors[strings.ToLower(level)]
+}
+
+// lineColor returns the color to print ev in: its broker's, unless it's
+// a notification whose formatter picks another.
+func (b *Broker) lineColor(ev *Event) *color.Color {
+	if ev.Kind == EventKindNotification {
+		if format, ok := notificationFormatters[ev.Method]; ok {
+			if _, c := format(ev.Params); c != nil {
+				return c
+			}
+		}
+	}
+	return b.Color
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// TestRegisteredFormatters checks that notifications print with the
+// formatter registered for their method, built-in or not.
+func TestRegisteredFormatters(t *testing.T) {
+	parseFlags(t)
+
+	progress := color.New(color.FgCyan)
+	registerFormatter("Progress", func(params *json.RawMessage) (string, *color.Color) {
+		return "# " + string(*params) + "%", progress
+	})
+	defer delete(notificationFormatters, "Progress")
+
+	b := newBroker("formatters", time.Now().UTC())
+	defer b.Retire()
+
+	for _, test := range []struct {
+		method string
+		params string
+		line   string
+		color  *color.Color
+	}{
+		{"Log", `{"level":"error","message":"boom"}`, "# boom", logLevelColors["error"]},
+		{"Log", `{"message":"plain"}`, "# plain", b.Color},
+		{"Progress", `42`, "# 42%", progress},
+	} {
+		params := json.RawMessage(test.params)
+		ev := &Event{
+			Start:  now(),
+			Kind:   EventKindNotification,
+			Method: test.method,
+			Params: &params,
+		}
+		if line := ev.String(); line != test.line {
+			t.Errorf("%s %s printed as %q, want %q", test.method, test.params, line, test.line)
+		}
+		if c := b.lineColor(ev); c != test.color {
+			t.Errorf("%s %s printed in the wrong color", test.method, test.params)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	framingLine         = "line"
+	framingLengthPrefix = "length-prefix"
+	// Content-Length headers, then a blank line, like LSP
+	framingHeader = "header"
+)
+
+// Largest header block teacup will wait for, with --framing header.
+const maxHeaderSize = 64 * 1024
+
+// maxMessageSize is the largest message teacup will buffer, with any
+// framing. bufio.Scanner's own default of 64KiB is too small for many
+// protocols, so it's never left in place.
+func maxMessageSize() int {
+	return int(*maxMessageBytes)
+}
+
+// errMessageTooLong is the cause of split errors about messages over
+// --max-message-size, whose length was known upfront.
+var errMessageTooLong = errors.New("message exceeds --max-message-size")
+
+// isTooLong returns whether reading stopped at a message over
+// --max-message-size.
+func isTooLong(err error) bool {
+	return err == bufio.ErrTooLong || errors.Cause(err) == errMessageTooLong
+}
+
+// tooLongEvent returns an event for a message over --max-message-size,
+// which teacup couldn't forward.
+func tooLongEvent(inbound bool) *Event {
+	at := now()
+	return &Event{
+		Start:   at,
+		End:     at,
+		Kind:    EventKindMalformed,
+		Inbound: inbound,
+		Status:  EventStatusErrored,
+		Error: &RpcError{
+			Message: fmt.Sprintf("message over --max-message-size (%s) not forwarded, connection closed", *maxMessageBytes),
+		},
+	}
+}
+
+// A frame is a message as it was received: its payload, and with
+// --framing header, the header block before it, so that both can be
+// forwarded unchanged.
+type frame struct {
+	header  string
+	payload string
+}
+
+// A messageScanner yields one message per token, without its framing,
+// and keeps the header block of the last one with --framing header.
+type messageScanner struct {
+	*bufio.Scanner
+	header string
+}
+
+// newMessageScanner returns a scanner that yields one message per token,
+// without its framing, according to --framing.
+func newMessageScanner(r io.Reader) *messageScanner {
+	s := &messageScanner{Scanner: bufio.NewScanner(r)}
+	s.Buffer(nil, maxMessageSize())
+	switch *framing {
+	case framingLengthPrefix:
+		s.Split(splitLengthPrefixed)
+	case framingHeader:
+		s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := splitHeaderFramed(data, atEOF)
+			if token != nil {
+				s.header = string(data[:advance-len(token)])
+			}
+			return advance, token, err
+		})
+	}
+	return s
+}
+
+// Frame returns the last message scanned, as it was received.
+func (s *messageScanner) Frame() frame {
+	return frame{header: s.header, payload: s.Text()}
+}
+
+// splitHeaderFramed is a bufio.SplitFunc for messages preceded by headers
+// and a blank line, of which only Content-Length matters. Lines should end
+// with "\r\n", but bare "\n" is accepted too.
+func splitHeaderFramed(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	end, sepLen := headerEnd(data)
+	if end < 0 {
+		if len(data) > maxHeaderSize {
+			return 0, nil, errors.Errorf("no end of headers after %d bytes", len(data))
+		}
+		if atEOF && len(bytes.TrimSpace(data)) > 0 {
+			return 0, nil, errors.Errorf("truncated headers: %q", data)
+		}
+		if atEOF {
+			// trailing blank lines
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+
+	length := -1
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name, value = line[:i], line[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			continue
+		}
+		length, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || length < 0 {
+			return 0, nil, errors.Errorf("invalid Content-Length %q", strings.TrimSpace(value))
+		}
+	}
+	if length < 0 {
+		return 0, nil, errors.Errorf("headers without Content-Length: %q", data[:end])
+	}
+	if length > maxMessageSize() {
+		return 0, nil, errors.Wrapf(errMessageTooLong, "message of %d bytes", length)
+	}
+
+	start := end + sepLen
+	stop := start + length
+	if len(data) < stop {
+		if atEOF {
+			return 0, nil, errors.Errorf("truncated message (%d of %d bytes)", len(data)-start, length)
+		}
+		return 0, nil, nil
+	}
+	return stop, data[start:stop], nil
+}
+
+// headerEnd returns where the blank line ending the headers in data
+// starts, and how long it is, or -1 if it's not there yet.
+func headerEnd(data []byte) (int, int) {
+	end, sepLen := bytes.Index(data, []byte("\r\n\r\n")), 4
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 && (end < 0 || i < end) {
+		end, sepLen = i, 2
+	}
+	return end, sepLen
+}
+
+// splitLengthPrefixed is a bufio.SplitFunc for messages preceded by their
+// length, as an unsigned integer of --prefix-size bytes.
+func splitLengthPrefixed(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	size := *prefixSize
+	if len(data) < size {
+		if atEOF && len(data) > 0 {
+			return 0, nil, errors.Errorf("truncated length prefix (%d of %d bytes)", len(data), size)
+		}
+		return 0, nil, nil
+	}
+
+	length := readPrefix(data[:size])
+	if length > uint64(maxMessageSize()) {
+		return 0, nil, errors.Wrapf(errMessageTooLong, "message of %d bytes", length)
+	}
+	end := size + int(length)
+	if len(data) < end {
+		if atEOF {
+			return 0, nil, errors.Errorf("truncated message (%d of %d bytes)", len(data)-size, length)
+		}
+		return 0, nil, nil
+	}
+	return end, data[size:end], nil
+}
+
+func prefixOrder() binary.ByteOrder {
+	if *prefixEndian == "little" {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func readPrefix(b []byte) uint64 {
+	order := prefixOrder()
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	default:
+		return order.Uint64(b)
+	}
+}
+
+func putPrefix(b []byte, length uint64) {
+	order := prefixOrder()
+	switch len(b) {
+	case 1:
+		b[0] = byte(length)
+	case 2:
+		order.PutUint16(b, uint16(length))
+	case 4:
+		order.PutUint32(b, uint32(length))
+	default:
+		order.PutUint64(b, length)
+	}
+}
+
+// forwardFrame writes f to w as it was received, and flushes it. Its
+// header block is only kept with --framing header, as it's the one
+// that has any.
+func forwardFrame(w *bufio.Writer, f frame) error {
+	if *framing != framingHeader || f.header == "" {
+		return writeFrame(w, []byte(f.payload))
+	}
+
+	_, err := w.WriteString(f.header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = w.WriteString(f.payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// writeFrame writes a single message to w, framed according to --framing,
+// and flushes it.
+func writeFrame(w *bufio.Writer, payload []byte) error {
+	var err error
+	switch *framing {
+	case framingHeader:
+		_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(payload))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = w.Write(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	case framingLengthPrefix:
+		if *prefixSize < 8 && uint64(len(payload)) >= uint64(1)<<(8*uint(*prefixSize)) {
+			return errors.Errorf("message of %d bytes does not fit a %d-byte length prefix", len(payload), *prefixSize)
+		}
+		prefix := make([]byte, *prefixSize)
+		putPrefix(prefix, uint64(len(payload)))
+		_, err = w.Write(prefix)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = w.Write(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	default:
+		_, err = w.Write(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = w.WriteByte('\n')
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
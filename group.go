@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// GroupStats counts traffic for one value of the --group-by key.
+type GroupStats struct {
+	Requests      int
+	Errors        int
+	Notifications int
+}
+
+// groupKey extracts the --group-by key from a raw message.
+func groupKey(msgString string) string {
+	if *groupBy == "" {
+		return ""
+	}
+
+	value, ok := extractPath([]byte(msgString), *groupBy)
+	if !ok {
+		return ""
+	}
+
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	return string(compactJSON(value))
+}
+
+func (b *Broker) groupStats(ev *Event) *GroupStats {
+	if *groupBy == "" {
+		return nil
+	}
+
+	if b.Groups == nil {
+		b.Groups = make(map[string]*GroupStats)
+	}
+	stats, ok := b.Groups[ev.Group]
+	if !ok {
+		stats = &GroupStats{}
+		b.Groups[ev.Group] = stats
+	}
+	return stats
+}
+
+func (b *Broker) countGroup(ev *Event) {
+	stats := b.groupStats(ev)
+	if stats == nil {
+		return
+	}
+
+	switch {
+	case ev.Kind == EventKindNotification:
+		stats.Notifications++
+	case ev.Kind == EventKindRequest && ev.Status == EventStatusPending:
+		stats.Requests++
+	case ev.Status == EventStatusErrored:
+		stats.Errors++
+	}
+}
+
+// reportGroups prints a summary of traffic for each --group-by key.
+func (b *Broker) reportGroups() {
+	var keys []string
+	for key := range b.Groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		stats := b.Groups[key]
+		name := key
+		if name == "" {
+			name = "(none)"
+		}
+
+		errorRate := 0.0
+		if stats.Requests > 0 {
+			errorRate = float64(stats.Errors) / float64(stats.Requests) * 100
+		}
+		b.announce("Σ", "%s: %d requests, %d errors (%.0f%%), %d notifications",
+			name, stats.Requests, stats.Errors, errorRate, stats.Notifications)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "time"
+
+// hangCheckInterval is how often a connection looks for requests
+// pending longer than --hang-alert.
+func hangCheckInterval() time.Duration {
+	return checkInterval(*hangAlert)
+}
+
+// checkInterval is how often to look for requests pending longer
+// than threshold, to notice them soon enough.
+func checkInterval(threshold time.Duration) time.Duration {
+	interval := threshold / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// CheckHangs alerts, once per request, about requests that have been
+// pending for longer than --hang-alert. They're left alone otherwise.
+func (b *Broker) CheckHangs() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, requests := range []PendingRequests{b.OutboundRequests, b.InboundRequests} {
+		for _, req := range requests {
+			if req.hangAlerted {
+				continue
+			}
+			age := time.Since(*req.Start)
+			if age < *hangAlert {
+				continue
+			}
+			req.hangAlerted = true
+			b.alert("[%s] %s has been pending for %s, it may be stuck", req.ID, req.Method, age.Round(time.Millisecond))
+		}
+	}
+}
+
+// StopTimeouts stops the --request-timeout timers of every pending
+// request, once their replies can't be seen anymore.
+func (b *Broker) StopTimeouts() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, req := range b.OutboundRequests {
+		if req.timeout != nil {
+			req.timeout.Stop()
+		}
+	}
+}
+
+// watchSlowRequests periodically warns about the requests of every live
+// connection that have been pending for longer than --slow-threshold, and
+// again each time they've waited that long once more.
+func watchSlowRequests(threshold time.Duration) {
+	for range time.Tick(checkInterval(threshold)) {
+		for _, b := range registry.Snapshot() {
+			b.CheckSlow(threshold)
+		}
+	}
+}
+
+// CheckSlow warns about requests still pending after threshold, or after
+// a multiple of it they haven't been warned about yet.
+func (b *Broker) CheckSlow(threshold time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, requests := range []PendingRequests{b.OutboundRequests, b.InboundRequests} {
+		for _, req := range requests {
+			age := time.Since(*req.Start)
+			if age < time.Duration(req.slowWarnings+1)*threshold {
+				continue
+			}
+			req.slowWarnings = int(age / threshold)
+			b.warn("still waiting for [%s] %s after %s", req.ID, req.Method, age.Round(time.Millisecond))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// extractPath looks up a dotted path like "$.payload.items.0" in a JSON
+// document. Object keys and array indices are both plain path segments,
+// and the leading "$." is optional.
+func extractPath(input []byte, path string) (json.RawMessage, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	current := json.RawMessage(input)
+	if path == "" {
+		return current, true
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(current, &object) == nil {
+			value, ok := object[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+			continue
+		}
+
+		var array []json.RawMessage
+		if json.Unmarshal(current, &array) == nil {
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(array) {
+				return nil, false
+			}
+			current = array[index]
+			continue
+		}
+
+		return nil, false
+	}
+	return current, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// MethodStats collects how long requests for one method took, for --stats.
+// Only completed requests count towards the timings.
+type MethodStats struct {
+	Method    string
+	Completed int
+	Errored   int
+	Cancelled int
+	Min       time.Duration
+	Max       time.Duration
+	Total     time.Duration
+}
+
+// Mean returns the average duration of completed requests.
+func (s *MethodStats) Mean() time.Duration {
+	if s.Completed == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Completed)
+}
+
+func (b *Broker) countMethod(ev *Event) {
+	if !*methodStats || ev.Kind != EventKindRequest || ev.Status == EventStatusPending || ev.Status == EventStatusOrphan || ev.Status == EventStatusDropped {
+		return
+	}
+
+	if b.Methods == nil {
+		b.Methods = make(map[string]*MethodStats)
+	}
+	stats, ok := b.Methods[ev.Method]
+	if !ok {
+		stats = &MethodStats{Method: ev.Method}
+		b.Methods[ev.Method] = stats
+	}
+
+	switch ev.Status {
+	case EventStatusErrored:
+		stats.Errored++
+	case EventStatusCancelled:
+		stats.Cancelled++
+	case EventStatusCompleted:
+		d := ev.Duration()
+		if stats.Completed == 0 || d < stats.Min {
+			stats.Min = d
+		}
+		if d > stats.Max {
+			stats.Max = d
+		}
+		stats.Total += d
+		stats.Completed++
+	}
+}
+
+// reportMethods prints a table of request latencies per method, slowest
+// on average first.
+func (b *Broker) reportMethods() {
+	var all []*MethodStats
+	width := 0
+	for _, stats := range b.Methods {
+		all = append(all, stats)
+		if len(stats.Method) > width {
+			width = len(stats.Method)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Mean() != all[j].Mean() {
+			return all[i].Mean() > all[j].Mean()
+		}
+		return all[i].Method < all[j].Method
+	})
+
+	for _, stats := range all {
+		total := stats.Completed + stats.Errored + stats.Cancelled
+		failed := float64(stats.Errored+stats.Cancelled) / float64(total) * 100
+		b.announce("⏱", "%-*s %5d ok  mean %-10s min %-10s max %-10s %4d errored %4d cancelled (%.0f%% failed)",
+			width, stats.Method, stats.Completed, roundDuration(stats.Mean()), roundDuration(stats.Min), roundDuration(stats.Max),
+			stats.Errored, stats.Cancelled, failed)
+	}
+}
+
+// roundDuration keeps durations in the table short.
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
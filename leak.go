@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// number of handleConn goroutines currently running
+var activeConns int64
+
+// how many more connections than its baseline teacup must have open
+// while traffic is idle before we suspect a leak, so that clients
+// ramping up aren't flagged
+const leakThreshold = 10
+
+// leakWatch compares the connections open whenever traffic is idle. A
+// connection teacup failed to clean up stays open without any requests
+// in flight, so it shows up then, unlike connections that are busy.
+type leakWatch struct {
+	// fewest connections seen open while traffic was idle, or -1
+	baseline int64
+	// connections open at the last warning
+	warned int64
+}
+
+// sample records how many connections are open and how many requests
+// are in flight, and returns whether it looks like a leak.
+func (w *leakWatch) sample(conns int64, inFlight int) bool {
+	if inFlight > 0 {
+		return false
+	}
+	if w.baseline < 0 || conns < w.baseline {
+		w.baseline = conns
+		w.warned = conns
+		return false
+	}
+	if conns < w.baseline+leakThreshold || conns <= w.warned {
+		return false
+	}
+	w.warned = conns
+	return true
+}
+
+// inFlightRequests counts the pending requests of every live connection
+// that's observed.
+func inFlightRequests() int {
+	n := 0
+	for _, b := range registry.Snapshot() {
+		outbound, inbound := b.Pending()
+		n += outbound + inbound
+	}
+	return n
+}
+
+// watchLeaks periodically checks whether more and more connections stay
+// open while idle, which would suggest teacup isn't cleaning up after
+// itself.
+func watchLeaks(interval time.Duration) {
+	watch := leakWatch{baseline: -1}
+	for range time.Tick(interval) {
+		conns := atomic.LoadInt64(&activeConns)
+		if watch.sample(conns, inFlightRequests()) {
+			log.Printf("Warning: %d connections are open while no requests are in flight, up from %d (%d goroutines), teacup may be leaking connections",
+				conns, watch.baseline, runtime.NumGoroutine())
+		}
+	}
+}
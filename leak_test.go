@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestLeakWatch(t *testing.T) {
+	samples := []struct {
+		conns    int64
+		inFlight int
+		leak     bool
+	}{
+		{2, 0, false},
+		// clients ramping up
+		{3, 0, false},
+		{11, 0, false},
+		// busy, not idle
+		{40, 7, false},
+		{12, 0, true},
+		// already warned about
+		{12, 0, false},
+		{13, 0, true},
+		// a new baseline
+		{1, 0, false},
+		{10, 0, false},
+		{11, 0, true},
+	}
+
+	watch := leakWatch{baseline: -1}
+	for i, s := range samples {
+		if leak := watch.sample(s.conns, s.inFlight); leak != s.leak {
+			t.Errorf("sample %d (%d connections, %d in flight): got leak %t, want %t", i, s.conns, s.inFlight, leak, s.leak)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listenTCP opens teacup's TCP listener.
+//
+// There is no way to size the listen backlog: Go always asks for the
+// largest one the OS allows (net.core.somaxconn on Linux, kern.ipc.somaxconn
+// on BSDs and macOS), so raise that instead if connections get dropped.
+// SO_REUSEADDR is likewise always set on Unix. SO_REUSEPORT, with
+// --reuse-port, lets a restarted teacup bind while the old socket lingers,
+// and is only available on Linux and BSDs (including macOS).
+func listenTCP(address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if *reusePort {
+		lc.Control = func(network string, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// listenUnix opens teacup's listener on a Unix socket at path, replacing
+// the socket file a previous teacup may have left behind. Anything at path
+// that isn't a socket is left alone.
+func listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,13 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import "syscall"
+
+// syscall is missing SO_REUSEPORT on some architectures,
+// but it's the same everywhere except MIPS.
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !(linux && !mips && !mipsle && !mips64 && !mips64le)
+
+package main
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
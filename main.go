@@ -6,8 +6,15 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/fatih/color"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -15,12 +22,107 @@ const defaultPort = 8686
 
 var (
 	app = kingpin.New("teacup", "A cozy debugging JSON-over-RPC TCP proxy")
+
+	proxyCmd = app.Command("proxy", "Listen for clients and proxy them to their upstream").Default()
+
+	replayRequestsCmd = app.Command("replay-requests", "Re-send the client requests of a --log-dir capture to an upstream, with fresh ids")
+	replayCapture     = replayRequestsCmd.Arg("capture", "Log file written by --log-dir or --record").Required().ExistingFile()
+	replayUpstream    = replayRequestsCmd.Arg("upstream", "Address of the TCP endpoint to replay against").Required().String()
+
+	replayCmd       = app.Command("replay", "Print the events of a --record or --log-dir file again, as they happened")
+	replayRecording = replayCmd.Arg("file", "File written by --record or --log-dir").Required().ExistingFile()
+	replaySpeed     = replayCmd.Flag("speed", "How much faster than the original to replay, or 0 to print everything at once").Default("1").Float64()
+
+	host            = app.Flag("host", "Address to listen on").Default("localhost").String()
+	port            = app.Flag("port", "Port to listen on").Default(strconv.Itoa(defaultPort)).Int()
+	bind            = app.Flag("bind", "Address to listen on as host:port, instead of --host and --port").String()
+	listenSocket    = app.Flag("listen-unix", "Listen on a Unix socket at this path instead of TCP").String()
+	handshakeWait   = app.Flag("handshake-timeout", "How long to wait for a client's Proxy.Connect before dropping it, or 0 to wait indefinitely").Default("1s").Duration()
+	hexdumpOnError  = app.Flag("hexdump-on-error", "When a client's first message isn't JSON, log a hex dump of its first bytes, to diagnose clients speaking another protocol").Bool()
+	noColor         = app.Flag("no-color", "Don't color the output, even on a terminal (also set by the NO_COLOR environment variable)").Bool()
+	randomColors    = app.Flag("random-colors", "Pick a random color for each connection, instead of the same one for the same upstream").Bool()
+	paletteFile     = app.Flag("palette-file", "Write the color assigned to each broker to this file, one JSON object per line, with the scheme that picked it").String()
+	gapMarker       = app.Flag("gap-marker", "Print an explicit idle event when a broker is quiet for longer than this").Duration()
+	upstreamAddress = app.Flag("upstream", "Connect every client to this address (host:port or unix:/path) instead of the one passed to Proxy.Connect").String()
+	dialTimeout     = app.Flag("dial-timeout", "How long to wait for an upstream to accept a connection (Proxy.Connect can override it with \"dialTimeout\" in milliseconds), or 0 for the OS limit").Default("1s").Duration()
+	reconnectWait   = app.Flag("reconnect-wait", "When the upstream hangs up, keep the client connected this long, waiting for a Proxy.Reconnect (by default, the client is disconnected right away)").Default("0s").Duration()
+	keepalive       = app.Flag("keepalive", "Send TCP keepalives this often on client and upstream connections, so an upstream that vanished without closing the connection gets noticed").Duration()
+	routes          = app.Flag("route", "Let clients pass a name as the address in Proxy.Connect, as name=host:port or name=unix:/path (repeatable)").StringMap()
+	tlsUpstream     = app.Flag("tls", "Connect to upstreams over TLS (Proxy.Connect can also ask for it with \"tls\": true)").Bool()
+	tlsInsecure     = app.Flag("tls-insecure", "With TLS, don't verify upstream certificates").Bool()
+	tlsServerName   = app.Flag("tls-server-name", "With TLS, verify upstream certificates against this name instead of the upstream's host").String()
+	control         = app.Flag("control", "Read control commands from stdin: 'upstream host:port|unix:/path', 'observe on|off', 'dump'").Bool()
+	checkIDs        = app.Flag("check-ids", "Warn when a reply's id differs from its request's: 'loose' compares type and value, 'strict' compares the exact text").Default("off").Enum("off", "loose", "strict")
+	format          = app.Flag("format", "'pretty' for colored lines, or 'json' for one JSON object per event").Default("pretty").Enum("pretty", "json")
+	outputTemplate  = app.Flag("output-template", "With --format pretty, a text/template used to print each event, with fields .Time .Delta .Indent .Arrow .Broker .Summary .Group .ID .Method .Kind .Status .Duration .Inbound .Params .Result .Error .Size .ReplySize").Default(defaultLineFormat).String()
+	leakCheck       = app.Flag("leak-check", "Check this often whether more and more of teacup's connections stay open while no requests are in flight").Duration()
+	maxConns        = app.Flag("max-conns", "Refuse new connections while this many are active (0 for no limit)").Int64()
+	expectSequence  = app.Flag("expect-sequence", "Comma-separated method patterns each session should call in order (substring match), e.g. 'Meta.Authenticate,Fetch.Game'").String()
+	logDir          = app.Flag("log-dir", "Write each connection's events to its own JSON log file in this directory").ExistingDir()
+	unwrap          = app.Flag("unwrap", "Path (e.g. '$.payload') of the JSON-RPC message inside an envelope; messages are still forwarded whole").String()
+	errorRateAlert  = app.Flag("error-rate-alert", "Alert when a connection gets at least this many errors within --error-rate-window").Int()
+	errorRateWindow = app.Flag("error-rate-window", "Sliding window for --error-rate-alert, and for recentErrors in --http-addr").Default("10s").Duration()
+	reusePort       = app.Flag("reuse-port", "Set SO_REUSEPORT on the listener so teacup can restart without waiting for the old socket (Linux and BSDs only)").Bool()
+	timestamps      = app.Flag("timestamps", "Start each line with the time its event started, in UTC").Bool()
+	timeFormat      = app.Flag("time-format", "Layout of --timestamps, as for Go's time.Format, e.g. '2006-01-02T15:04:05.000Z07:00' for RFC 3339").Default("15:04:05.000").String()
+	globalClock     = app.Flag("global-clock", "Show the time since the previous event of any connection, instead of the same connection, for a single timeline").Bool()
+	sinceConnect    = app.Flag("since-connect", "Show the time since the client connected instead of the time since the previous event").Bool()
+	logPaired       = app.Flag("log-paired", "In --log-dir and --record logs, write a single record per request once it completes, errors or is cancelled").Bool()
+	ellipsis        = app.Flag("ellipsis", "Appended to params, results and errors that are too long to print in full").Default("...").String()
+	ellipsisCount   = app.Flag("ellipsis-count", "Also show how many bytes were left out, e.g. '...(+412 bytes)'").Bool()
+	maxWidth        = app.Flag("max-width", "Shorten params, results and errors longer than this many bytes, or 0 to print them in full").Default("60").Int()
+	prettyJSON      = app.Flag("pretty-json", "Print params and results indented, in full, beneath their event's line").Short('v').Bool()
+	assertNoOrphans = app.Flag("assert-no-orphans", "On SIGINT or SIGTERM, exit with status 1 if any reply had no request, or any request never got a reply").Bool()
+	methodStats     = app.Flag("stats", "When a connection closes, print how long requests took for each method, slowest on average first").Bool()
+	groupBy         = app.Flag("group-by", "Path (e.g. '$.params.tenant') of a key to summarize traffic by when a connection closes").String()
+	groupPrefix     = app.Flag("group-prefix", "Show the --group-by key in front of each event").Bool()
+	observeWindow   = app.Flag("observe-window", "Only observe each connection for this long after its first message, then just forward").Duration()
+	dupWindow       = app.Flag("dup-window", "Warn about requests identical (same id, method and params) to one sent less than this long ago").Duration()
+	diffRepeated    = app.Flag("diff", "When a request repeats an earlier one (same method and params), show how its result changed instead of the whole result").Bool()
+	protocol        = app.Flag("protocol", "JSON-RPC version of Proxy.Connect and teacup's replies to it; '1.0' has no jsonrpc field").Default("2.0").Enum("1.0", "2.0")
+	deadlineField   = app.Flag("deadline-field", "Path (e.g. '$.params.deadline') of the time a request may take, in milliseconds, as a duration or as an RFC 3339 timestamp; slower replies are marked").String()
+	statusLine      = app.Flag("status-line", "Keep a line with event, pending and error counts at the bottom of the terminal").Bool()
+	requestTimeout  = app.Flag("request-timeout", "Answer client requests with an error if the server hasn't replied after this long").Duration()
+	failOnCodes     = app.Flag("fail-on-code", "Drop the client's connection after forwarding an error reply with this JSON-RPC error code, to test reconnection logic (repeatable; use --fail-on-code=-32000 for negative codes)").Int64List()
+	delay           = app.Flag("delay", "Hold each message this long before forwarding it, to test clients' timeouts").Duration()
+	delayJitter     = app.Flag("delay-jitter", "Add a random delay of up to this long to --delay").Duration()
+	delayDirection  = app.Flag("delay-direction", "Which messages --delay holds: 'in' from the server, 'out' from the client, or both").Default("both").Enum("in", "out", "both")
+	dropRate        = app.Flag("drop-rate", "Fraction of messages to drop instead of forwarding them, between 0 and 1, to test clients' recovery").Float64()
+	randomSeed      = app.Flag("seed", "Seed for --drop-rate and --delay-jitter, so that each connection drops and delays the same messages from one run to the next (0 for a random seed)").Int64()
+	rateLimit       = app.Flag("rate", "Forward at most this many messages per second in each direction, to test clients under backpressure (0 for no limit)").Float64()
+	cancelMethod    = app.Flag("cancel-method", "With --request-timeout, also send the server a notification with this method and the request id as {\"id\": ...}").String()
+	httpAddr        = app.Flag("http-addr", "Serve the status of every live connection as JSON over HTTP on this address, e.g. 'localhost:8687'").String()
+	expvarAddr      = app.Flag("expvar-addr", "Serve counters of connections, events, errors and bytes forwarded with expvar on this address, e.g. 'localhost:8688'").String()
+	metricsAddr     = app.Flag("metrics-addr", "Serve Prometheus metrics (events, request durations and requests in flight) on this address, at /metrics").String()
+	metricsMethods  = app.Flag("metrics-max-methods", "With --metrics-addr, how many distinct methods get their own label; later ones are counted as '(other)'").Default("100").Int()
+	wsAddr          = app.Flag("ws-addr", "Stream every printed event and note, as --format json would print them, to WebSocket clients on this address").String()
+	shutdownTimeout = app.Flag("shutdown-timeout", "On SIGINT or SIGTERM, how long to wait for connections to wrap up before exiting anyway").Default("5s").Duration()
+	dumpDir         = app.Flag("dump-dir", "Where to write the state of all connections on SIGUSR1 or the 'dump' control command").Default(".").ExistingDir()
+	maxMessageBytes = app.Flag("max-message-size", "Largest message teacup will buffer, e.g. 512KiB; a connection that sends a larger one is closed").Default("64MiB").Bytes()
+	framing         = app.Flag("framing", "How messages are delimited on the wire: one per line, preceded by their length, or preceded by a Content-Length header and a blank line (like LSP)").Default(framingLine).Enum(framingLine, framingLengthPrefix, framingHeader)
+	lsp             = app.Flag("lsp", "Frame messages like the Language Server Protocol, same as --framing header").Bool()
+	prefixSize      = app.Flag("prefix-size", "With --framing length-prefix, size of the length prefix in bytes (1, 2, 4 or 8)").Default("4").Int()
+	prefixEndian    = app.Flag("prefix-endian", "With --framing length-prefix, byte order of the length prefix").Default("big").Enum("big", "little")
+	collapseErrors  = app.Flag("collapse-errors", "Show consecutive identical errors (same connection, method, code and message) as a single line with a count").Bool()
+	connSample      = app.Flag("connection-sample", "Fraction of connections to observe, between 0 and 1; the others are only forwarded").Default("1").Float64()
+	matchByMethod   = app.Flag("match-by-method", "For servers that don't echo ids reliably: match replies with an unknown id to the oldest pending request (of the same method, if the reply has one)").Bool()
+	stubFiles       = app.Flag("stub", "Answer requests for a method with the JSON result in a file instead of forwarding them, as method=file (repeatable)").StringMap()
+	hangAlert       = app.Flag("hang-alert", "Alert once about each request still pending after this long, without cancelling it").Duration()
+	slowThreshold   = app.Flag("slow-threshold", "Warn about requests still pending after this long, and again each time they've waited that long more").Duration()
+	recordPath      = app.Flag("record", "Write the events of all connections to this file, one JSON object per line").String()
+	mute            = app.Flag("mute", "Don't print events whose method contains this text, e.g. 'Fetch.' mutes every Fetch method (repeatable)").Strings()
+	muteFile        = app.Flag("mute-file", "Like --mute, for each line of this file; blank lines and lines starting with '#' are skipped").ExistingFile()
+	direction       = app.Flag("direction", "Only print events started by the server ('in') or by the client ('out'), e.g. requests along with their replies; forwarding is unaffected").Default("both").Enum("in", "out", "both")
+	statuses        = app.Flag("status", "Only print events with this status, e.g. 'errored' (repeatable). A request is printed at each change of status, so without 'pending' it first shows up once answered").Enums(string(EventStatusPending), string(EventStatusCompleted), string(EventStatusErrored), string(EventStatusCancelled), string(EventStatusOrphan), string(EventStatusDropped))
+	only            = app.Flag("only", "Only print events whose method contains this text, before applying --mute (repeatable)").Strings()
+	muteRegex       = app.Flag("mute-regex", "Don't print events whose method matches this regular expression, e.g. '^Profile\\.Data$' (repeatable)").Strings()
+	onlyRegex       = app.Flag("only-regex", "Only print events whose method matches this regular expression, or an --only value (repeatable)").Strings()
 )
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	_, err := app.Parse(os.Args[1:])
+	cmd, err := app.Parse(os.Args[1:])
 	if err != nil {
 		ctx, _ := app.ParseContext(os.Args[1:])
 		if ctx != nil {
@@ -30,31 +132,240 @@ func main() {
 		}
 	}
 
-	start()
+	switch cmd {
+	case replayRequestsCmd.FullCommand():
+		setup()
+		err := replayRequests(*replayCapture, *replayUpstream)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+	case replayCmd.FullCommand():
+		setup()
+		err := replaySession(*replayRecording, *replaySpeed)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+	default:
+		start()
+	}
 }
 
-func start() {
+// setup applies the flags that shape teacup's output and how it
+// observes messages, for all commands.
+func setup() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.Ltime | log.Lmicroseconds | log.LUTC)
 
-	address := fmt.Sprintf("localhost:%d", defaultPort)
-	listener, err := net.Listen("tcp", address)
-	must(err)
+	// color already turns itself off when stdout isn't a terminal
+	if *noColor || os.Getenv("NO_COLOR") != "" {
+		color.NoColor = true
+	}
+
+	if *statusLine && isTerminal(os.Stdout) {
+		status = &statusWriter{out: color.Output}
+		color.Output = status
+		log.SetOutput(status)
+	}
+
+	if *paletteFile != "" {
+		f, err := os.Create(*paletteFile)
+		must(err)
+		setPaletteOutput(f)
+	}
+
+	var err error
+	if *format == "json" {
+		sink = &jsonSink{w: os.Stdout}
+		// keep stdout parseable
+		log.SetOutput(os.Stderr)
+	}
+	lineTemplate, err = template.New("line").Parse(*outputTemplate)
+	if err != nil {
+		app.FatalUsage("invalid --output-template: %s\n", err.Error())
+	}
+
+	if *lsp {
+		if *framing == framingLengthPrefix {
+			app.FatalUsage("--lsp and --framing %s can't be used together\n", *framing)
+		}
+		*framing = framingHeader
+	}
+
+	switch *prefixSize {
+	case 1, 2, 4, 8:
+	default:
+		app.FatalUsage("invalid --prefix-size: %d, expected 1, 2, 4 or 8\n", *prefixSize)
+	}
+
+	for name, target := range *routes {
+		if name == "" || target == "" {
+			app.FatalUsage("invalid --route %s=%s, expected name=host:port\n", name, target)
+		}
+	}
+
+	// written this way round to reject NaN too
+	if !(*dropRate >= 0 && *dropRate <= 1) {
+		app.FatalUsage("invalid --drop-rate: %g, expected a fraction between 0 and 1\n", *dropRate)
+	}
+	if !(*connSample >= 0 && *connSample <= 1) {
+		app.FatalUsage("invalid --connection-sample: %g, expected a fraction between 0 and 1\n", *connSample)
+	}
+
+	expectedSequence = parseSequence(*expectSequence)
+	setUpstreamOverride(*upstreamAddress)
+
+	if *recordPath != "" {
+		err = openRecord(*recordPath)
+		if err != nil {
+			app.Fatalf("could not create --record file: %s", err)
+		}
+	}
+
+	err = muteMethods(*mute, *muteFile)
+	if err != nil {
+		app.Fatalf("could not read --mute-file: %s", err)
+	}
+
+	mutedPatterns = compilePatterns("--mute-regex", *muteRegex)
+	onlyPatterns = compilePatterns("--only-regex", *onlyRegex)
+
+	err = loadStubs(*stubFiles)
+	if err != nil {
+		app.FatalUsage("invalid --stub: %s\n", err.Error())
+	}
+}
+
+func start() {
+	setup()
+
+	if *control {
+		go readControl(os.Stdin)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		printSummary()
+		beginShutdown()
+	}()
+	dumpSignals := make(chan os.Signal, 1)
+	notifyDump(dumpSignals)
+	go func() {
+		for range dumpSignals {
+			err := controlDump(nil)
+			if err != nil {
+				log.Printf("While dumping broker state: %+v", err)
+			}
+		}
+	}()
+
+	if *leakCheck > 0 {
+		go watchLeaks(*leakCheck)
+	}
+	if *slowThreshold > 0 {
+		go watchSlowRequests(*slowThreshold)
+	}
+	if *httpAddr != "" {
+		err := serveStatus(*httpAddr)
+		if err != nil {
+			app.Fatalf("could not serve status on %s: %s", *httpAddr, err)
+		}
+		log.Printf("Serving connection status on http://%s/", *httpAddr)
+	}
+	if *expvarAddr != "" {
+		err := serveExpvar(*expvarAddr)
+		if err != nil {
+			app.Fatalf("could not serve counters on %s: %s", *expvarAddr, err)
+		}
+		log.Printf("Serving counters on http://%s/", *expvarAddr)
+	}
+	if *metricsAddr != "" {
+		err := serveMetrics(*metricsAddr)
+		if err != nil {
+			app.Fatalf("could not serve metrics on %s: %s", *metricsAddr, err)
+		}
+		log.Printf("Serving Prometheus metrics on http://%s/metrics", *metricsAddr)
+	}
+	if *wsAddr != "" {
+		hub := newWebsocketHub()
+		err := serveWebsocket(*wsAddr, hub)
+		if err != nil {
+			app.Fatalf("could not stream events on %s: %s", *wsAddr, err)
+		}
+		sink = multiSink{sink, &jsonSink{w: hub}}
+		log.Printf("Streaming events on ws://%s/", *wsAddr)
+	}
+
+	serve(listen())
+	shutdown()
+}
+
+// listen opens the listener for clients, as set by --listen-unix, --bind,
+// or --host and --port.
+func listen() net.Listener {
+	if *listenSocket != "" {
+		listener, err := listenUnix(*listenSocket)
+		if err != nil {
+			app.Fatalf("could not listen on %s: %s", *listenSocket, err)
+		}
+		log.Printf("Teacup proxy listening on %s", *listenSocket)
+		return listener
+	}
+
+	address := net.JoinHostPort(*host, strconv.Itoa(*port))
+	if *bind != "" {
+		_, bindPort, err := net.SplitHostPort(*bind)
+		if err == nil {
+			_, err = strconv.ParseUint(bindPort, 10, 16)
+		}
+		if err != nil {
+			app.FatalUsage("invalid --bind %q, expected host:port, e.g. 0.0.0.0:8686 or [::1]:8686\n", *bind)
+		}
+		address = *bind
+	}
+	listener, err := listenTCP(address)
+	if err != nil {
+		app.Fatalf("could not listen on %s (pick another address with --host and --port): %s", address, err)
+	}
 	log.Printf("Teacup proxy listening on %s", address)
+	return listener
+}
 
-	for {
-		acceptOne(listener)
+func compilePatterns(flag string, patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			app.FatalUsage("invalid %s: %s\n", flag, err.Error())
+		}
+		compiled = append(compiled, re)
 	}
+	return compiled
 }
 
 func acceptOne(listener net.Listener) {
 	conn, err := listener.Accept()
 	if err != nil {
-		log.Printf("While accepting: %+v", err)
+		if shutdownCtx.Err() == nil {
+			log.Printf("While accepting: %+v", err)
+		}
+		return
+	}
+
+	if *maxConns > 0 && atomic.LoadInt64(&activeConns) >= *maxConns {
+		log.Printf("Refusing connection from %s: already %d active", conn.RemoteAddr(), *maxConns)
+		conn.Close()
 		return
 	}
 
-	go handleConn(conn)
+	acceptedConnections.Add(1)
+	atomic.AddInt64(&activeConns, 1)
+	connections.Add(1)
+	go func() {
+		defer connections.Done()
+		defer atomic.AddInt64(&activeConns, -1)
+		handleConn(conn)
+	}()
 }
 
 func must(err error) {
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counters published with expvar, under "teacup", for --expvar-addr.
+// They cover all connections since teacup started.
+var (
+	metrics = expvar.NewMap("teacup")
+
+	acceptedConnections = new(expvar.Int)
+	// new events per kind; updates to a request don't count again
+	eventsByKind = new(expvar.Map).Init()
+	// requests that got an error reply
+	requestErrors = new(expvar.Int)
+	// bytes of messages forwarded, without their framing
+	bytesToServer = new(expvar.Int)
+	bytesToClient = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("acceptedConnections", acceptedConnections)
+	metrics.Set("activeConnections", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&activeConns)
+	}))
+	metrics.Set("events", eventsByKind)
+	metrics.Set("errors", requestErrors)
+	metrics.Set("bytesToServer", bytesToServer)
+	metrics.Set("bytesToClient", bytesToClient)
+}
+
+// serveExpvar answers GET requests on address with every published
+// expvar, including teacup's counters and Go's memstats, as JSON.
+func serveExpvar(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:     expvar.Handler(),
+		ReadTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
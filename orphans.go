@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// completeness keeps track of requests that never got a reply and replies
+// that never had a request, across all connections, for --assert-no-orphans.
+var completeness struct {
+	sync.Mutex
+	unanswered map[*Event]bool
+	orphans    []string
+}
+
+func trackRequest(ev *Event) {
+	if !*assertNoOrphans {
+		return
+	}
+
+	completeness.Lock()
+	defer completeness.Unlock()
+	if completeness.unanswered == nil {
+		completeness.unanswered = make(map[*Event]bool)
+	}
+	completeness.unanswered[ev] = true
+}
+
+func trackAnswer(ev *Event) {
+	if !*assertNoOrphans {
+		return
+	}
+
+	completeness.Lock()
+	defer completeness.Unlock()
+	delete(completeness.unanswered, ev)
+}
+
+func trackOrphan(b *Broker, id RpcID) {
+	if !*assertNoOrphans {
+		return
+	}
+
+	completeness.Lock()
+	defer completeness.Unlock()
+	completeness.orphans = append(completeness.orphans, fmt.Sprintf("%s reply to unknown request [%s]", b.Name, id))
+}
+
+// checkCompleteness logs every orphan reply and unanswered request,
+// and returns the exit code teacup should use.
+func checkCompleteness() int {
+	completeness.Lock()
+	defer completeness.Unlock()
+
+	var problems []string
+	problems = append(problems, completeness.orphans...)
+	for ev := range completeness.unanswered {
+		problems = append(problems, fmt.Sprintf("%s [%s] %s never got a reply", ev.Broker.Name, ev.ID, ev.Method))
+	}
+	sort.Strings(problems)
+
+	for _, problem := range problems {
+		log.Print(problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("%d orphan replies, %d unanswered requests", len(completeness.orphans), len(completeness.unanswered))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+var colorNames = map[color.Attribute]string{
+	color.FgWhite:     "white",
+	color.FgBlue:      "blue",
+	color.FgHiBlue:    "hiblue",
+	color.FgGreen:     "green",
+	color.FgHiGreen:   "higreen",
+	color.FgYellow:    "yellow",
+	color.FgHiYellow:  "hiyellow",
+	color.FgCyan:      "cyan",
+	color.FgHiCyan:    "hicyan",
+	color.FgMagenta:   "magenta",
+	color.FgHiMagenta: "himagenta",
+}
+
+// colorAttribute returns the color named name in colorNames.
+func colorAttribute(name string) (color.Attribute, bool) {
+	for attr, attrName := range colorNames {
+		if attrName == name {
+			return attr, true
+		}
+	}
+	return 0, false
+}
+
+// how brokerColor picks colors, as recorded in the palette file
+const (
+	// an FNV-1a hash of the broker's name, modulo the number of colors
+	schemeHash = "fnv32a"
+	// a random one, with --random-colors
+	schemeRandom = "random"
+)
+
+// PaletteEntry records which color a broker was printed in, so that
+// plain logs can be recolored by a post-processing tool.
+type PaletteEntry struct {
+	Broker string `json:"broker"`
+	Color  string `json:"color"`
+	// ANSI SGR code for Color
+	Code int `json:"code"`
+	// how Color was picked, so the same colors can be assigned again
+	Scheme string `json:"scheme"`
+}
+
+func paletteScheme() string {
+	if *randomColors {
+		return schemeRandom
+	}
+	return schemeHash
+}
+
+var palette struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func setPaletteOutput(w io.Writer) {
+	palette.Lock()
+	defer palette.Unlock()
+	palette.w = w
+}
+
+func recordPalette(name string, attr color.Attribute) {
+	palette.Lock()
+	defer palette.Unlock()
+
+	if palette.w == nil {
+		return
+	}
+
+	entry := PaletteEntry{
+		Broker: name,
+		Color:  colorNames[attr],
+		Code:   int(attr),
+		Scheme: paletteScheme(),
+	}
+	payload, err := json.Marshal(entry)
+	must(err)
+
+	_, err = palette.w.Write(append(payload, '\n'))
+	if err != nil {
+		log.Printf("While writing palette entry: %+v", err)
+	}
+}
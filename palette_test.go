@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"testing"
+)
+
+// TestPaletteRecordsScheme checks that a palette entry says how its color
+// was picked, and that the hash scheme gives the same color again.
+func TestPaletteRecordsScheme(t *testing.T) {
+	for _, random := range []bool{false, true} {
+		*randomColors = random
+		var buf bytes.Buffer
+		setPaletteOutput(&buf)
+
+		name := "{upstream:4000}"
+		recordPalette(name, brokerColor(name))
+
+		var entry PaletteEntry
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("palette entry %q: %v", buf.String(), err)
+		}
+		if entry.Broker != name {
+			t.Errorf("got broker %q, want %q", entry.Broker, name)
+		}
+
+		switch entry.Scheme {
+		case schemeHash:
+			if random {
+				t.Errorf("got scheme %q with --random-colors", entry.Scheme)
+			}
+			h := fnv.New32a()
+			h.Write([]byte(entry.Broker))
+			if want := colors[h.Sum32()%uint32(len(colors))]; entry.Code != int(want) {
+				t.Errorf("got color %s (%d), the hash gives %s (%d)", entry.Color, entry.Code, colorNames[want], want)
+			}
+		case schemeRandom:
+			if !random {
+				t.Errorf("got scheme %q without --random-colors", entry.Scheme)
+			}
+		default:
+			t.Errorf("unknown scheme %q", entry.Scheme)
+		}
+	}
+	*randomColors = false
+	setPaletteOutput(nil)
+}
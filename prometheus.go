@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the request duration histogram, in seconds, the same
+// as the Prometheus client's defaults
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// methods past --metrics-max-methods are all counted under this label
+const otherMethods = "(other)"
+
+type eventKey struct {
+	method string
+	kind   EventKind
+}
+
+type durationKey struct {
+	method string
+	status EventStatus
+}
+
+type histogram struct {
+	// cumulative, one per durationBuckets
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// promMetrics holds what --metrics-addr serves, since teacup started.
+// In-flight requests are read from the live brokers on each scrape.
+var promMetrics struct {
+	sync.Mutex
+	methods   map[string]bool
+	events    map[eventKey]uint64
+	durations map[durationKey]*histogram
+}
+
+// metricsMethod returns the method label to use for method, once
+// --metrics-max-methods distinct methods have been seen.
+func metricsMethod(method string) string {
+	if promMetrics.methods == nil {
+		promMetrics.methods = make(map[string]bool)
+	}
+	if promMetrics.methods[method] {
+		return method
+	}
+	if len(promMetrics.methods) >= *metricsMethods {
+		return otherMethods
+	}
+	promMetrics.methods[method] = true
+	return method
+}
+
+// countEvent counts a new event, for --metrics-addr.
+func countEvent(ev *Event) {
+	if *metricsAddr == "" {
+		return
+	}
+	promMetrics.Lock()
+	defer promMetrics.Unlock()
+
+	if promMetrics.events == nil {
+		promMetrics.events = make(map[eventKey]uint64)
+	}
+	promMetrics.events[eventKey{metricsMethod(ev.Method), ev.Kind}]++
+}
+
+// observeDuration records how long a request took to complete, error
+// or get cancelled, for --metrics-addr.
+func observeDuration(ev *Event) {
+	if *metricsAddr == "" {
+		return
+	}
+	promMetrics.Lock()
+	defer promMetrics.Unlock()
+
+	if promMetrics.durations == nil {
+		promMetrics.durations = make(map[durationKey]*histogram)
+	}
+	key := durationKey{metricsMethod(ev.Method), ev.Status}
+	h := promMetrics.durations[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		promMetrics.durations[key] = h
+	}
+
+	seconds := ev.Duration().Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// labelValue escapes s for the Prometheus text format.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeMetrics writes every metric in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	promMetrics.Lock()
+	var events []string
+	for key, n := range promMetrics.events {
+		events = append(events, fmt.Sprintf("teacup_events_total{method=\"%s\",kind=\"%s\"} %d\n",
+			labelValue(key.method), key.kind, n))
+	}
+	var durations []string
+	for key, h := range promMetrics.durations {
+		labels := fmt.Sprintf("method=\"%s\",status=\"%s\"", labelValue(key.method), key.status)
+		var lines strings.Builder
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&lines, "teacup_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(&lines, "teacup_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&lines, "teacup_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(&lines, "teacup_request_duration_seconds_count{%s} %d\n", labels, h.count)
+		durations = append(durations, lines.String())
+	}
+	promMetrics.Unlock()
+
+	// connections to the same upstream share a name, and Prometheus
+	// rejects scrapes with duplicate series, so they're summed
+	pendingByName := make(map[string]int)
+	for _, b := range registry.Snapshot() {
+		outbound, inbound := b.Pending()
+		b.mu.RLock()
+		name := b.Name
+		b.mu.RUnlock()
+		pendingByName[name] += outbound + inbound
+	}
+	var inFlight []string
+	for name, pending := range pendingByName {
+		inFlight = append(inFlight, fmt.Sprintf("teacup_inflight_requests{connection=\"%s\"} %d\n",
+			labelValue(name), pending))
+	}
+
+	sort.Strings(events)
+	sort.Strings(durations)
+	sort.Strings(inFlight)
+
+	fmt.Fprint(w, "# HELP teacup_events_total Messages observed, by method and kind.\n# TYPE teacup_events_total counter\n")
+	fmt.Fprint(w, strings.Join(events, ""))
+	fmt.Fprint(w, "# HELP teacup_request_duration_seconds How long requests took to complete, error or get cancelled.\n# TYPE teacup_request_duration_seconds histogram\n")
+	fmt.Fprint(w, strings.Join(durations, ""))
+	fmt.Fprint(w, "# HELP teacup_inflight_requests Requests waiting for a reply, by connection name.\n# TYPE teacup_inflight_requests gauge\n")
+	fmt.Fprint(w, strings.Join(inFlight, ""))
+	fmt.Fprint(w, "# HELP teacup_active_connections Client connections currently open, observed or not.\n# TYPE teacup_active_connections gauge\n")
+	fmt.Fprintf(w, "teacup_active_connections %d\n", atomic.LoadInt64(&activeConns))
+}
+
+// serveMetrics answers GET /metrics on address for Prometheus.
+func serveMetrics(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
@@ -3,11 +3,17 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,67 +27,362 @@ const (
 	RpcCodeMethodNotFound RpcCode = -32601
 	RpcCodeInvalidParams  RpcCode = -32602
 	RpcCodeInternalError  RpcCode = -32603
+
+	// Implementation-defined: teacup gave up waiting for the server
+	RpcCodeRequestTimeout RpcCode = -32000
 )
 
 type ProxyConnectParams struct {
-	// Address of the TCP endpoint to connect to
+	// Address of the TCP endpoint to connect to, or path of a Unix
+	// socket, as "unix:/path/to.sock" or just "/path/to.sock", or name
+	// of a --route
 	Address string `json:"address"`
+
+	// The following are optional, and override teacup's defaults for
+	// this connection only.
+
+	// Name to show for this connection instead of the upstream port
+	Label string `json:"label,omitempty"`
+	// Connect to the upstream over TLS
+	TLS bool `json:"tls,omitempty"`
+	// With TLS, name to verify the upstream's certificate against.
+	// Defaults to --tls-server-name, then to the host in Address.
+	ServerName string `json:"serverName,omitempty"`
+	// With TLS, accept any certificate from the upstream
+	TLSInsecure bool `json:"tlsInsecure,omitempty"`
+	// How long to wait for the upstream to accept, in milliseconds.
+	// Defaults to --dial-timeout.
+	DialTimeout int64 `json:"dialTimeout,omitempty"`
+}
+
+// upstreamNetwork returns the network and address to dial for an upstream
+// address: Unix socket paths start with "unix:" or "/", anything else is
+// a TCP host:port.
+func upstreamNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix", strings.TrimPrefix(address, "unix:")
+	}
+	if strings.HasPrefix(address, "/") {
+		return "unix", address
+	}
+	return "tcp", address
+}
+
+// upstreamTLS returns how to connect to the upstream at address over TLS,
+// from the Proxy.Connect params and the --tls flags, or nil for plain TCP.
+// Certificates are checked against the host of address, unless another
+// name is given. address is the one actually dialed, so it may come from
+// --upstream rather than params.
+func upstreamTLS(params ProxyConnectParams, address string) *tls.Config {
+	if !params.TLS && !*tlsUpstream {
+		return nil
+	}
+
+	config := &tls.Config{
+		ServerName:         params.ServerName,
+		InsecureSkipVerify: params.TLSInsecure || *tlsInsecure,
+	}
+	if config.ServerName == "" {
+		config.ServerName = *tlsServerName
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = address
+		}
+	}
+	return config
+}
+
+// jsonrpcVersion returns the "jsonrpc" field teacup expects in Proxy.Connect
+// and sends in its own replies. JSON-RPC 1.0 has no such field.
+func jsonrpcVersion() string {
+	if *protocol == "1.0" {
+		return ""
+	}
+	return *protocol
 }
 
 type ProxyConnectResult struct {
 	OK bool `json:"ok"`
 }
 
+// answerPing replies to msgString if it's a Proxy.Ping, which clients can
+// send before Proxy.Connect to check that teacup is up, and reports
+// whether it was one.
+func answerPing(w *bufio.Writer, msgString string) bool {
+	var msg RpcMessage
+	if json.Unmarshal([]byte(msgString), &msg) != nil || msg.Method != "Proxy.Ping" {
+		return false
+	}
+	if msg.ID == "" {
+		return true
+	}
+
+	err := replyOK(w, msg.ID)
+	if err != nil {
+		log.Printf("Could not answer Proxy.Ping: %+v", err)
+	}
+	return true
+}
+
+// replyOK answers the request id, sent to teacup itself, with success.
+func replyOK(w *bufio.Writer, id RpcID) error {
+	resultPayload, err := json.Marshal(ProxyConnectResult{OK: true})
+	must(err)
+	resultPayloadRaw := json.RawMessage(resultPayload)
+
+	payload, err := json.Marshal(RpcMessage{
+		JSONRPC: jsonrpcVersion(),
+		ID:      id,
+		Result:  &resultPayloadRaw,
+	})
+	must(err)
+
+	return writeFrame(w, payload)
+}
+
+// how much of an unparseable first message --hexdump-on-error shows
+const hexdumpSize = 256
+
+// logHexdump logs the start of msgString as a hex dump. The framing has
+// already been taken off, e.g. the newline with line framing.
+func logHexdump(msgString string) {
+	dumped := msgString
+	if len(dumped) > hexdumpSize {
+		dumped = dumped[:hexdumpSize]
+	}
+	log.Printf("First %d of %d bytes received:\n%s", len(dumped), len(msgString), hex.Dump([]byte(dumped)))
+}
+
+// reconnectRequest returns msgString decoded, if it's a Proxy.Reconnect,
+// which clients send to switch to another upstream mid-session. It takes
+// the same params as Proxy.Connect.
+func reconnectRequest(msgString string) (*RpcMessage, bool) {
+	var msg RpcMessage
+	if json.Unmarshal([]byte(msgString), &msg) != nil || msg.Method != "Proxy.Reconnect" || msg.ID == "" {
+		return nil, false
+	}
+	return &msg, true
+}
+
+// errFailingCode ends a connection after a reply with one of
+// --fail-on-code, which has already been logged.
+var errFailingCode = errors.New("reply with a --fail-on-code error")
+
+// failingCode returns the error code of the reply msgString, or of any
+// reply in it if it's a batch, if it's one of --fail-on-code.
+func failingCode(msgString string) (int64, bool) {
+	if len(*failOnCodes) == 0 {
+		return 0, false
+	}
+
+	elements := []json.RawMessage{json.RawMessage(msgString)}
+	if batch, ok := batchElements(msgString); ok {
+		elements = batch
+	}
+	for _, element := range elements {
+		var msg RpcMessage
+		if json.Unmarshal(element, &msg) != nil || msg.Method != "" || msg.Error == nil {
+			continue
+		}
+		for _, code := range *failOnCodes {
+			if msg.Error.Code == code {
+				return code, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// resolveUpstream returns the address to dial for params, after --route
+// and --upstream, and the label to show for the connection.
+func resolveUpstream(params ProxyConnectParams) (string, string) {
+	address := params.Address
+	label := params.Label
+	if target, ok := (*routes)[address]; ok {
+		if label == "" {
+			label = address
+		}
+		address = target
+	}
+	if override := upstreamOverride(); override != "" {
+		address = override
+	}
+
+	if label == "" {
+		if network, path := upstreamNetwork(address); network == "unix" {
+			label = filepath.Base(path)
+		} else if _, port, err := net.SplitHostPort(address); err == nil {
+			label = port
+		} else {
+			label = address
+		}
+	}
+	return address, label
+}
+
+// dialUpstream connects to address, as params ask.
+func dialUpstream(params ProxyConnectParams, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   *dialTimeout,
+		KeepAlive: *keepalive,
+	}
+	if params.DialTimeout > 0 {
+		dialer.Timeout = time.Duration(params.DialTimeout) * time.Millisecond
+	}
+
+	network, dialAddress := upstreamNetwork(address)
+	if config := upstreamTLS(params, dialAddress); config != nil {
+		return tls.DialWithDialer(dialer, network, dialAddress, config)
+	}
+	return dialer.Dial(network, dialAddress)
+}
+
+// setKeepAlive turns on TCP keepalives for conn, with --keepalive as the
+// period. Connections that aren't TCP are left as they are.
+func setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if *keepalive <= 0 || !ok {
+		return
+	}
+	err := tcpConn.SetKeepAlive(true)
+	if err == nil {
+		err = tcpConn.SetKeepAlivePeriod(*keepalive)
+	}
+	if err != nil {
+		log.Printf("While enabling keepalives on %s: %+v", conn.RemoteAddr(), err)
+	}
+}
+
+var upstream struct {
+	sync.Mutex
+	address string
+}
+
+// upstreamOverride returns the address all new connections should go to,
+// regardless of what they asked for in Proxy.Connect, or "" if unset.
+func upstreamOverride() string {
+	upstream.Lock()
+	defer upstream.Unlock()
+	return upstream.address
+}
+
+func setUpstreamOverride(address string) {
+	upstream.Lock()
+	defer upstream.Unlock()
+	upstream.address = address
+}
+
+// sampleConnection decides whether a new connection gets observed,
+// with --connection-sample.
+func sampleConnection() bool {
+	return *connSample >= 1 || rand.Float64() < *connSample
+}
+
+// set to 1 to skip processMessage entirely, so that teacup only forwards.
+// Requests seen before a pause may never be marked as completed.
+var observationPaused int32
+
 func handleConn(clientConn net.Conn) {
-	ctx, cancel := context.WithCancel(context.Background())
+	connectedAt := time.Now().UTC()
+	ctx, cancel := context.WithCancel(shutdownCtx)
+	setKeepAlive(clientConn)
+
+	// the readers get to see the connections closed before handleConn
+	// returns, so none of them outlives it
+	var readers sync.WaitGroup
+	defer readers.Wait()
+	defer cancel()
 
 	clientR := bufio.NewReader(clientConn)
 	clientW := bufio.NewWriter(clientConn)
 	defer clientConn.Close()
 
-	clientIncoming := make(chan string)
+	// receives how the client's connection ended, unless teacup itself
+	// closed it
+	hangups := make(chan string, 1)
+	// receives whether a message over --max-message-size came from the
+	// server (true) or the client, which ends the connection
+	tooLong := make(chan bool, 2)
+
+	clientIncoming := make(chan frame)
+	readers.Add(1)
 	go func() {
+		defer readers.Done()
 		defer cancel()
-		scanner := bufio.NewScanner(clientR)
+		scanner := newMessageScanner(clientR)
 		for scanner.Scan() {
-			line := scanner.Text()
-			clientIncoming <- line
+			select {
+			case clientIncoming <- scanner.Frame():
+			case <-ctx.Done():
+				return
+			}
+		}
+		if isTooLong(scanner.Err()) {
+			select {
+			case tooLong <- false:
+			default:
+			}
 		}
-		err := scanner.Err()
-		if err != nil && !isErrClosed(err) {
-			log.Printf("While reading from client: %+v", err)
+		if hangup := describeHangup("client", scanner.Err()); hangup != "" {
+			hangups <- hangup
 		}
 	}()
 
+	// a nil channel never fires, so 0 waits indefinitely
+	var handshakeDeadline <-chan time.Time
+	if *handshakeWait > 0 {
+		handshakeDeadline = time.After(*handshakeWait)
+	}
+
 	var proxyConnectLine string
-	select {
-	case proxyConnectLine = <-clientIncoming:
-		// good!
-	case <-time.After(1 * time.Second):
-		log.Printf("Timed out waiting for Proxy.Connect")
-		return
+handshake:
+	for {
+		select {
+		case f := <-clientIncoming:
+			proxyConnectLine = f.payload
+			if !answerPing(clientW, proxyConnectLine) {
+				break handshake
+			}
+		case <-ctx.Done():
+			// client left before connecting
+			return
+		case <-handshakeDeadline:
+			log.Printf("Timed out waiting for Proxy.Connect after %s (see --handshake-timeout)", *handshakeWait)
+			return
+		}
 	}
 
 	var connectReq RpcMessage
 	var serverConn net.Conn
 	var serverAddress string
-	var serverR *bufio.Reader
+	var label string
 	var serverW *bufio.Writer
+	defer func() {
+		if serverConn != nil {
+			serverConn.Close()
+		}
+	}()
 	{
 		err := json.Unmarshal([]byte(proxyConnectLine), &connectReq)
 		if err != nil {
 			log.Printf("While unmarshalling Proxy.Connect message %+v", err)
+			if *hexdumpOnError {
+				logHexdump(proxyConnectLine)
+			}
 			return
 		}
 
-		if connectReq.JSONRPC != "2.0" {
-			log.Printf("Expected request to have json-rpc: 2.0, but got %q", connectReq.JSONRPC)
+		if connectReq.JSONRPC != jsonrpcVersion() {
+			log.Printf("Expected request to have json-rpc: %q, but got %q", jsonrpcVersion(), connectReq.JSONRPC)
 			return
 		}
 
 		replyError := func(errorCode RpcCode, errorMessage string) {
 			var msg = RpcMessage{
-				JSONRPC: "2.0",
+				JSONRPC: jsonrpcVersion(),
 				ID:      connectReq.ID,
 				Error: &RpcError{
 					Code:    int64(errorCode),
@@ -92,15 +393,10 @@ func handleConn(clientConn net.Conn) {
 			payload, err := json.Marshal(msg)
 			must(err)
 
-			_, err = clientW.Write(payload)
+			err = writeFrame(clientW, payload)
 			if err != nil {
 				log.Printf("Could not write error to client: %+v", err)
 			}
-
-			err = clientW.Flush()
-			if err != nil {
-				log.Printf("Could not flush to client: %+v", err)
-			}
 		}
 
 		if connectReq.Method != "Proxy.Connect" {
@@ -118,122 +414,180 @@ func handleConn(clientConn net.Conn) {
 			log.Print(errMsg)
 			return
 		}
-		serverAddress = params.Address
-
-		serverConn, err = net.DialTimeout("tcp", serverAddress, 1*time.Second)
+		serverAddress, label = resolveUpstream(params)
+		serverConn, err = dialUpstream(params, serverAddress)
 		if err != nil {
 			errMsg := fmt.Sprintf("While connecting to %s: %+v", serverAddress, err)
 			replyError(RpcCodeInternalError, errMsg)
-			log.Printf(errMsg)
+			log.Print(errMsg)
 			return
 		}
-		defer serverConn.Close()
-
-		serverR = bufio.NewReader(serverConn)
 		serverW = bufio.NewWriter(serverConn)
 
-		var result = ProxyConnectResult{
-			OK: true,
-		}
-		resultPayload, err := json.Marshal(result)
-		must(err)
-		resultPayloadRaw := json.RawMessage(resultPayload)
-
-		var connectRes = RpcMessage{
-			JSONRPC: "2.0",
-			ID:      connectReq.ID,
-			Result:  &resultPayloadRaw,
-		}
-
-		connectResPayload, err := json.Marshal(connectRes)
-		must(err)
-
-		_, err = clientW.Write(connectResPayload)
-		if err != nil {
-			log.Printf("While writing Proxy.Connect response: %+v", err)
-			return
-		}
-
-		err = clientW.WriteByte('\n')
+		err = replyOK(clientW, connectReq.ID)
 		if err != nil {
 			log.Printf("While writing Proxy.Connect response: %+v", err)
 			return
 		}
+	}
 
-		err = clientW.Flush()
-		if err != nil {
-			log.Printf("While writing Proxy.Connect response: %+v", err)
-			return
-		}
+	// readServer forwards messages from conn until it's closed, or until
+	// stop is called once it's been replaced by Proxy.Reconnect. The
+	// second channel receives how the server hung up, if it did.
+	readServer := func(conn net.Conn) (<-chan frame, <-chan string, func()) {
+		incoming := make(chan frame)
+		hangup := make(chan string, 1)
+		stopped := make(chan struct{})
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			scanner := newMessageScanner(bufio.NewReader(conn))
+			for scanner.Scan() {
+				select {
+				case incoming <- scanner.Frame():
+				case <-stopped:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+			if isTooLong(scanner.Err()) {
+				select {
+				case tooLong <- true:
+				default:
+				}
+			}
+			if description := describeHangup("server", scanner.Err()); description != "" {
+				hangup <- description
+			}
+		}()
+		return incoming, hangup, func() { close(stopped) }
 	}
+	serverIncoming, serverHangup, stopServer := readServer(serverConn)
 
-	serverIncoming := make(chan string)
-	go func() {
-		defer cancel()
-		scanner := bufio.NewScanner(serverR)
-		for scanner.Scan() {
-			line := scanner.Text()
-			serverIncoming <- line
-		}
-		err := scanner.Err()
-		if err != nil && !isErrClosed(err) {
-			log.Printf("While reading from server: %+v", err)
-		}
-	}()
+	// with --reconnect-wait, fires if the client hasn't sent a
+	// Proxy.Reconnect in time after the upstream hung up
+	var reconnectDeadline <-chan time.Time
+	upstreamGone := false
 
-	sendLine := func(w *bufio.Writer, line string) error {
-		var err error
-		_, err = w.WriteString(line)
+	writeMessage := func(w *bufio.Writer, msg interface{}) error {
+		payload, err := json.Marshal(msg)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		err = w.WriteByte('\n')
-		if err != nil {
-			return errors.WithStack(err)
+		return writeFrame(w, payload)
+	}
+
+	// the decision is made once, so a connection is either observed
+	// in full or not at all.
+	observing := sampleConnection()
+	var broker *Broker
+	if observing {
+		broker = newBroker(fmt.Sprintf("{%s}", label), connectedAt)
+	}
+	defer func() {
+		// Proxy.Reconnect may have replaced it
+		if broker != nil {
+			broker.Retire()
 		}
-		err = w.Flush()
-		if err != nil {
-			return errors.WithStack(err)
+	}()
+	if *connSample < 1 {
+		if observing {
+			log.Printf("Observing connection to %s as {%s}", serverAddress, label)
+		} else {
+			log.Printf("Only forwarding connection to %s (not sampled)", serverAddress)
 		}
-		return nil
 	}
 
-	serverPort := strings.Split(serverAddress, ":")[1]
-	broker := newBroker(fmt.Sprintf("{%s}", serverPort))
-	defer broker.Retire()
+	// with --request-timeout, receives client requests that took too
+	// long, and remembers their ids to drop late replies.
+	timeouts := make(chan *Event)
+	timedOut := make(map[RpcID]bool)
 
-	processMessage := func(inbound bool, msgString string) {
+	// for --drop-rate and --delay-jitter
+	rng := connectionRand()
+
+	// with --observe-window, fires once the window has elapsed
+	var observeDeadline <-chan time.Time
+
+	// with --hang-alert, fires to look for requests pending for too long
+	var hangChecks <-chan time.Time
+	if *hangAlert > 0 && broker != nil {
+		ticker := time.NewTicker(hangCheckInterval())
+		defer ticker.Stop()
+		hangChecks = ticker.C
+	}
+
+	// processOne observes a single message, that's not a batch.
+	processOne := func(inbound bool, msgString string) {
 		var msg RpcMessage
 		err := json.Unmarshal([]byte(msgString), &msg)
 		if err != nil {
+			// still forwarded as is, but the operator should know
+			if literal := nonStandardNumber(msgString); literal != "" {
+				broker.Warn("next message has non-standard number %s", literal)
+			}
+			ev := &Event{
+				Start:   now(),
+				Kind:    EventKindMalformed,
+				Inbound: inbound,
+				Raw:     msgString,
+				Size:    len(msgString),
+				Status:  EventStatusCompleted,
+			}
+			ev.AddTo(broker)
 			return
 		}
 
-		if msg.ID == 0 {
+		// only the absence of an id makes a notification, see RpcID
+		if msg.ID == "" {
 			ev := &Event{
 				Start:   now(),
 				Kind:    EventKindNotification,
 				Method:  msg.Method,
 				Inbound: inbound,
+				Raw:     msgString,
+				Size:    len(msgString),
 
 				Params: msg.Params,
 				Status: EventStatusCompleted,
+				Group:  groupKey(msgString),
 			}
 			ev.AddTo(broker)
 			return
 		}
 
-		if msg.Method != "" {
+		// with --match-by-method, a message with a method is still a reply
+		// if it has a result or an error: some servers echo the method.
+		isReply := *matchByMethod && (msg.Result != nil || msg.Error != nil)
+
+		if msg.Method != "" && !isReply {
 			// it's a fresh call!
+			start := now()
 			ev := &Event{
-				Start:   now(),
+				Start:   start,
 				ID:      msg.ID,
 				Kind:    EventKindRequest,
 				Method:  msg.Method,
 				Inbound: inbound,
+				Raw:     msgString,
+				Size:    len(msgString),
 
 				Params: msg.Params,
 				Status: EventStatusPending,
+				Group:  groupKey(msgString),
+				rawID:  rawID(msgString),
+
+				Deadline: deadlineOf(msgString, *start),
+			}
+			if *requestTimeout > 0 && !inbound {
+				// stopped when the request lands, see Landed
+				ev.timeout = time.AfterFunc(*requestTimeout, func() {
+					select {
+					case timeouts <- ev:
+					case <-ctx.Done():
+					}
+				})
 			}
 			ev.AddTo(broker)
 			return
@@ -241,35 +595,398 @@ func handleConn(clientConn net.Conn) {
 
 		req := broker.GetRequest(!inbound, msg.ID)
 		if req == nil {
+			// some setups loop replies back the way their request came
+			req = broker.GetRequest(inbound, msg.ID)
+			if req != nil {
+				sender := "client"
+				if inbound {
+					sender = "server"
+				}
+				broker.Warn("reply to %s [%s] was sent by the %s, like the request", req.Method, req.ID, sender)
+			}
+		}
+		if req == nil && *matchByMethod {
+			// heuristic for servers that don't echo ids reliably
+			req = broker.OldestRequest(!inbound, msg.Method)
+			if req != nil {
+				broker.Warn("reply with unknown id %s matched to oldest pending %s [%s]", msg.ID, req.Method, req.ID)
+			}
+		}
+		if req == nil {
+			if msg.ID == "null" && msg.Error != nil {
+				// the server couldn't tell which request this was
+				broker.Warn("error with null id: %s", trim(msg.Error.Message))
+			} else {
+				// often just because teacup joined mid-session
+				at := now()
+				ev := &Event{
+					Start:   at,
+					End:     at,
+					ID:      msg.ID,
+					Kind:    EventKindRequest,
+					Inbound: inbound,
+					Raw:     msgString,
+					Size:    len(msgString),
+
+					Result: msg.Result,
+					Error:  msg.Error,
+					Status: EventStatusOrphan,
+				}
+				ev.AddTo(broker)
+			}
 			// replying to a request that's not in-flight?
+			trackOrphan(broker, msg.ID)
 			return
 		}
 
 		if req != nil {
-			if msg.Error != nil {
-				req.RecordError(msg.Error)
-				return
+			if *checkIDs != "off" {
+				resID := rawID(msgString)
+				if !idReflected(req.rawID, resID, *checkIDs == "strict") {
+					broker.Warn("reply to %s was sent with id %s instead of %s", req.Method, resID, req.rawID)
+				}
 			}
 
-			req.RecordCompletion(msg.Result)
+			req.RecordReply(&msg, msgString)
 			return
 		}
 	}
 
+	// observe hands each message in msgString to process, unless the
+	// connection isn't observed.
+	observe := func(inbound bool, msgString string, process func(inbound bool, msgString string)) {
+		if !observing {
+			return
+		}
+		if atomic.LoadInt32(&observationPaused) == 1 {
+			// replies go unseen, so pending requests can't be timed out
+			broker.StopTimeouts()
+			return
+		}
+		if *observeWindow > 0 && observeDeadline == nil {
+			observeDeadline = time.After(*observeWindow)
+		}
+
+		if *unwrap != "" {
+			if inner, ok := extractPath([]byte(msgString), *unwrap); ok {
+				msgString = string(inner)
+			}
+		}
+
+		if batch, ok := batchElements(msgString); ok {
+			for _, element := range batch {
+				process(inbound, string(element))
+			}
+			return
+		}
+		process(inbound, msgString)
+	}
+
+	// processMessage only observes messages. Whatever it decodes, unwraps
+	// or renders, the main loop below forwards the line exactly as it was
+	// received, so transforms must never feed back into forwardFrame.
+	processMessage := func(inbound bool, msgString string) {
+		observe(inbound, msgString, processOne)
+	}
+
+	// recordDrop observes a message that --drop-rate kept from being
+	// forwarded.
+	recordDrop := func(inbound bool, msgString string) {
+		observe(inbound, msgString, func(inbound bool, msgString string) {
+			broker.droppedEvent(inbound, msgString).AddTo(broker)
+		})
+	}
+
+	// logHangup logs how a side's connection ended, and what was left
+	// pending on the broker.
+	logHangup := func(hangup string) {
+		select {
+		case inbound := <-tooLong:
+			if broker != nil {
+				tooLongEvent(inbound).AddTo(broker)
+			}
+		default:
+		}
+
+		if broker != nil {
+			outbound, inbound := broker.Pending()
+			hangup = fmt.Sprintf("%s, %d client and %d server requests were pending", hangup, outbound, inbound)
+		}
+		log.Printf("Connection to %s: %s", serverAddress, hangup)
+	}
+
+	// upstreamHungUp handles the server's hangup, once everything it
+	// sent was forwarded, and returns whether to end the connection.
+	upstreamHungUp := func(hangup string) bool {
+		logHangup(hangup)
+		if *reconnectWait <= 0 {
+			return true
+		}
+		// the client may still switch to another upstream
+		if broker != nil {
+			broker.Retire()
+		}
+		upstreamGone = true
+		reconnectDeadline = time.After(*reconnectWait)
+		return false
+	}
+
+	// with --delay or --rate, messages wait in line there, so that each
+	// one is held for its own delay while the other direction keeps
+	// flowing
+	startDelayLine := func() *delayLine {
+		line := newDelayLine()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			line.run(ctx)
+		}()
+		return line
+	}
+	var toClient, toServer *delayLine
+	// once the server hung up, toClient is drained before the hangup
+	// is handled
+	var draining *delayLine
+	var drainedHangup string
+	if delayed(true) || *rateLimit > 0 {
+		toClient = startDelayLine()
+	}
+	if delayed(false) || *rateLimit > 0 {
+		toServer = startDelayLine()
+	}
+
+	// forwardToClient forwards f from the server, once any --delay is
+	// over and --rate allows it. It returns errFailingCode to drop the
+	// client.
+	forwardToClient := func(f frame) error {
+		msg := f.payload
+		if len(timedOut) > 0 {
+			var reply RpcMessage
+			if json.Unmarshal([]byte(msg), &reply) == nil && reply.Method == "" && timedOut[reply.ID] {
+				// the client already got an error for this one
+				delete(timedOut, reply.ID)
+				broker.Warn("dropped late reply to timed out request [%s]", reply.ID)
+				return nil
+			}
+		}
+
+		if shouldDrop(rng) {
+			recordDrop(true, msg)
+			return nil
+		}
+
+		processMessage(true, msg)
+		err := forwardFrame(clientW, f)
+		bytesToClient.Add(int64(len(msg)))
+		if code, ok := failingCode(msg); ok && err == nil {
+			log.Printf("Connection to %s: dropping client after error %d (see --fail-on-code)", serverAddress, code)
+			return errFailingCode
+		}
+		return err
+	}
+
+	// forwardToServer forwards f from the client, once any --delay is
+	// over and --rate allows it, unless it's stubbed.
+	forwardToServer := func(f frame) error {
+		msg := f.payload
+		if upstreamGone {
+			// nowhere to forward it, but the client can reconnect
+			var req RpcMessage
+			if json.Unmarshal([]byte(msg), &req) == nil && req.Method != "" && req.ID != "" {
+				return writeMessage(clientW, RpcMessage{
+					JSONRPC: jsonrpcVersion(),
+					ID:      req.ID,
+					Error: &RpcError{
+						Code:    int64(RpcCodeInternalError),
+						Message: fmt.Sprintf("upstream %s hung up, send Proxy.Reconnect first", serverAddress),
+					},
+				})
+			}
+			return nil
+		}
+
+		if shouldDrop(rng) {
+			recordDrop(false, msg)
+			return nil
+		}
+
+		processMessage(false, msg)
+		if id, result, ok := stubFor(msg); ok {
+			// answered by teacup, the server never sees it
+			if broker != nil {
+				if req := broker.GetRequest(false, id); req != nil {
+					req.RecordStub(result)
+				}
+			}
+			return writeMessage(clientW, RpcMessage{
+				JSONRPC: jsonrpcVersion(),
+				ID:      id,
+				Result:  result,
+			})
+		}
+		err := forwardFrame(serverW, f)
+		bytesToServer.Add(int64(len(msg)))
+		return err
+	}
+
 	for {
 		var err error
 
+		// msg is forwarded verbatim (save for the line terminator),
+		// regardless of what processMessage makes of it.
 		select {
 		case msg := <-serverIncoming:
-			processMessage(true, msg)
-			err = sendLine(clientW, msg)
+			if toClient != nil {
+				// observed once it's actually forwarded
+				toClient.push(ctx, msg, forwardDelay(rng, true))
+				break
+			}
+			err = forwardToClient(msg)
+		case msg := <-toClient.released():
+			err = forwardToClient(msg)
 		case msg := <-clientIncoming:
-			processMessage(false, msg)
-			err = sendLine(serverW, msg)
+			if req, ok := reconnectRequest(msg.payload); ok {
+				var params ProxyConnectParams
+				paramsErr := errors.New("missing params")
+				if req.Params != nil {
+					paramsErr = json.Unmarshal(*req.Params, &params)
+				}
+				if paramsErr != nil {
+					err = writeMessage(clientW, RpcMessage{
+						JSONRPC: jsonrpcVersion(),
+						ID:      req.ID,
+						Error: &RpcError{
+							Code:    int64(RpcCodeInvalidParams),
+							Message: fmt.Sprintf("While unmarshalling Proxy.Reconnect params: %s", paramsErr),
+						},
+					})
+					break
+				}
+
+				address, newLabel := resolveUpstream(params)
+				conn, dialErr := dialUpstream(params, address)
+				if dialErr != nil {
+					// keep going with the current upstream
+					errMsg := fmt.Sprintf("While reconnecting to %s: %+v", address, dialErr)
+					log.Print(errMsg)
+					err = writeMessage(clientW, RpcMessage{
+						JSONRPC: jsonrpcVersion(),
+						ID:      req.ID,
+						Error: &RpcError{
+							Code:    int64(RpcCodeInternalError),
+							Message: errMsg,
+						},
+					})
+					break
+				}
+
+				stopServer()
+				serverConn.Close()
+				log.Printf("Reconnected from %s to %s", serverAddress, address)
+				serverConn, serverAddress = conn, address
+				serverW = bufio.NewWriter(serverConn)
+				serverIncoming, serverHangup, stopServer = readServer(serverConn)
+				timedOut = make(map[RpcID]bool)
+				upstreamGone = false
+				reconnectDeadline = nil
+				if toClient == nil && (delayed(true) || *rateLimit > 0) {
+					// the previous upstream's line is draining, if at all
+					toClient = startDelayLine()
+					drainedHangup = ""
+				}
+
+				if broker != nil {
+					// requests still pending will never get their reply
+					broker.Retire()
+					broker = newBroker(fmt.Sprintf("{%s}", newLabel), time.Now().UTC())
+				}
+				err = replyOK(clientW, req.ID)
+				break
+			}
+
+			if toServer != nil {
+				toServer.push(ctx, msg, forwardDelay(rng, false))
+				break
+			}
+			err = forwardToServer(msg)
+		case msg := <-toServer.released():
+			err = forwardToServer(msg)
+		case req := <-timeouts:
+			id := req.ID
+			if broker == nil || broker.GetRequest(false, id) != req {
+				// got a reply in time, or the timer was already stale
+				// when Landed stopped it
+				continue
+			}
+			timedOut[id] = true
+
+			if *cancelMethod != "" {
+				err = writeMessage(serverW, RpcNotification{
+					JSONRPC: jsonrpcVersion(),
+					Method:  *cancelMethod,
+					Params:  map[string]RpcID{"id": id},
+				})
+				if err != nil {
+					break
+				}
+			}
+
+			rpcErr := &RpcError{
+				Code:    int64(RpcCodeRequestTimeout),
+				Message: fmt.Sprintf("timed out by teacup after %s", *requestTimeout),
+			}
+			req.RecordError(rpcErr)
+			err = writeMessage(clientW, RpcMessage{
+				JSONRPC: jsonrpcVersion(),
+				ID:      id,
+				Error:   rpcErr,
+			})
+		case <-observeDeadline:
+			observing = false
+			broker.StopTimeouts()
+			events, pending := broker.Counts()
+			broker.Announce("⏹", "observed %s: %d events, %d requests still pending; only forwarding from now on",
+				*observeWindow, events, pending)
+		case <-hangChecks:
+			broker.CheckHangs()
+		case hangup := <-serverHangup:
+			serverIncoming, serverHangup = nil, nil
+			if toClient != nil {
+				// what the server sent is still owed to the client
+				draining, drainedHangup = toClient, hangup
+				draining.close()
+				toClient = nil
+				break
+			}
+			if upstreamHungUp(hangup) {
+				return
+			}
+		case msg, ok := <-draining.released():
+			if ok {
+				err = forwardToClient(msg)
+				break
+			}
+			draining = nil
+			if drainedHangup != "" && upstreamHungUp(drainedHangup) {
+				return
+			}
+		case <-reconnectDeadline:
+			log.Printf("Connection to %s: no Proxy.Reconnect within %s of the upstream hanging up (see --reconnect-wait)", serverAddress, *reconnectWait)
+			return
 		case <-ctx.Done():
+			select {
+			case hangup := <-hangups:
+				logHangup(hangup)
+			default:
+				// teacup is shutting down
+			}
 			return
 		}
 
+		if err == errFailingCode {
+			cancel()
+			return
+		}
 		if err != nil {
 			log.Printf("%+v", err)
 			return
@@ -277,6 +994,21 @@ func handleConn(clientConn net.Conn) {
 	}
 }
 
+// describeHangup says how reading from side ended with err, or returns ""
+// if teacup closed the connection itself.
+func describeHangup(side string, err error) string {
+	switch {
+	case err == nil:
+		return fmt.Sprintf("%s closed connection", side)
+	case isTooLong(err):
+		return fmt.Sprintf("%s sent a message over --max-message-size (%s)", side, *maxMessageBytes)
+	case isErrClosed(err):
+		return ""
+	default:
+		return fmt.Sprintf("%s connection failed: %+v", side, err)
+	}
+}
+
 func isErrClosed(err error) bool {
 	if err == nil {
 		return false
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// parseFlags sets teacup's flags as if it had been started with args,
+// with everything it prints thrown away.
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+
+	_, err := app.Parse(append([]string{"proxy"}, args...))
+	if err != nil {
+		t.Fatalf("parsing %v: %v", args, err)
+	}
+	// setup only ever replaces the sink
+	sink = prettySink{}
+	setup()
+
+	log.SetOutput(ioutil.Discard)
+	color.Output = ioutil.Discard
+	if _, ok := sink.(*jsonSink); ok {
+		sink = &jsonSink{w: ioutil.Discard}
+	}
+}
+
+// frames returns messages framed according to --framing, as teacup
+// would write them.
+func frames(t *testing.T, messages ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, msg := range messages {
+		err := writeFrame(w, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// TestForwardingIsVerbatim checks that whatever teacup makes of the
+// messages it observes, each peer receives exactly the bytes the other
+// one sent.
+func TestForwardingIsVerbatim(t *testing.T) {
+	for _, framingName := range []string{framingLine, framingLengthPrefix, framingHeader} {
+		for _, formatName := range []string{"pretty", "json"} {
+			t.Run(framingName+"/"+formatName, func(t *testing.T) {
+				parseFlags(t,
+					"--framing", framingName,
+					"--format", formatName,
+					"--unwrap", "$.payload",
+					"--pretty-json",
+					"--diff",
+					"--max-width", "8",
+					"--check-ids", "strict",
+					"--dup-window", "1s",
+					"--group-by", "$.params.tenant",
+					"--stats",
+				)
+				testForwarding(t, framingName)
+			})
+		}
+	}
+}
+
+func testForwarding(t *testing.T, framingName string) {
+	clientMessages := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"Game.Fetch","params":{"tenant":"a"}}`,
+		`{ "jsonrpc" : "2.0", "id" : "1.0", "method" : "Game.Fetch", "params" : { "tenant" : "a" } }`,
+		`{"jsonrpc":"2.0","method":"Note","params":{"text":"café ☕"}}`,
+		`{"payload":{"jsonrpc":"2.0","id":3,"method":"Wrapped"},"extra":true}`,
+		`[{"jsonrpc":"2.0","id":4,"method":"A"},{"jsonrpc":"2.0","method":"B"}]`,
+		`{"jsonrpc":"2.0","id":5,"method":"Odd","params":NaN}`,
+		`not json at all`,
+	}
+	serverMessages := []string{
+		`{"jsonrpc":"2.0","id":1,"result":{"n":1}}`,
+		`{"jsonrpc":"2.0","id":"1.0","result":{"n":2,"extra":[1,2,3]}}`,
+		`{"jsonrpc":"2.0","method":"Log","params":{"level":"error","message":"boom"}}`,
+		`{"payload":{"jsonrpc":"2.0","id":3,"error":{"code":-32000,"message":"wrapped"}}}`,
+		`[{"jsonrpc":"2.0","id":4,"result":null}]`,
+		`{"jsonrpc":"2.0","id":99,"result":"nobody asked"}`,
+	}
+	if framingName != framingLine {
+		// only lines can't carry pretty-printed JSON
+		clientMessages = append(clientMessages, "{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 6,\n  \"method\": \"Pretty\"\n}")
+		serverMessages = append(serverMessages, "{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 6,\n  \"result\": {\n    \"ok\": true\n  }\n}")
+	}
+	clientBytes := frames(t, clientMessages...)
+	serverBytes := frames(t, serverMessages...)
+	if framingName == framingHeader {
+		// other headers, and their order and case, are left as they were
+		msg := `{"jsonrpc":"2.0","id":7,"method":"Typed"}`
+		clientBytes = append(clientBytes, fmt.Sprintf("Content-Type: application/vscode-jsonrpc; charset=utf-8\r\ncontent-length: %d\r\n\r\n%s", len(msg), msg)...)
+		msg = `{"jsonrpc":"2.0","id":7,"result":"typed"}`
+		serverBytes = append(serverBytes, fmt.Sprintf("Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s", len(msg), msg)...)
+	}
+
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		received := make([]byte, len(clientBytes))
+		n, err := io.ReadFull(conn, received)
+		if err != nil {
+			return fmt.Errorf("upstream received only %q: %v", received[:n], err)
+		}
+		if !bytes.Equal(received, clientBytes) {
+			t.Errorf("upstream received:\n%q\nclient sent:\n%q", received, clientBytes)
+		}
+
+		_, err = conn.Write(serverBytes)
+		return err
+	})
+	defer hangUp()
+
+	_, err := clientConn.Write(clientBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]byte, len(serverBytes))
+	n, err := io.ReadFull(clientConn, received)
+	if err != nil {
+		t.Fatalf("client received only %q: %v (%v)", received[:n], err, <-upstreamErr)
+	}
+	if !bytes.Equal(received, serverBytes) {
+		t.Errorf("client received:\n%q\nupstream sent:\n%q", received, serverBytes)
+	}
+
+	err = <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connectThroughProxy runs handleConn for a client on a net.Pipe, that
+// Proxy.Connects to a loopback upstream where serve handles the
+// connection. It returns the client's end, what serve returned once it
+// has, and a function to hang up and wait for handleConn.
+func connectThroughProxy(t *testing.T, serve func(conn net.Conn) error) (net.Conn, <-chan error, func()) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamErr := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			upstreamErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		upstreamErr <- serve(conn)
+	}()
+
+	clientConn, proxyConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(proxyConn)
+	}()
+	hangUp := func() {
+		clientConn.Close()
+		<-done
+	}
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	connectParams, err := json.Marshal(ProxyConnectParams{Address: listener.Addr().String()})
+	if err != nil {
+		hangUp()
+		t.Fatal(err)
+	}
+	connect := frames(t, `{"jsonrpc":"2.0","id":0,"method":"Proxy.Connect","params":`+string(connectParams)+`}`)
+	_, err = clientConn.Write(connect)
+	if err != nil {
+		hangUp()
+		t.Fatal(err)
+	}
+	replies := newMessageScanner(clientConn)
+	if !replies.Scan() {
+		hangUp()
+		t.Fatalf("no reply to Proxy.Connect: %v", replies.Err())
+	}
+	var reply RpcMessage
+	err = json.Unmarshal(replies.Bytes(), &reply)
+	if err != nil || reply.Error != nil {
+		hangUp()
+		t.Fatalf("Proxy.Connect failed: %s (%v)", replies.Text(), err)
+	}
+	return clientConn, upstreamErr, hangUp
+}
+
+// expectNoMessage fails if the client receives anything within d.
+func expectNoMessage(t *testing.T, clientConn net.Conn, replies *messageScanner, d time.Duration) {
+	t.Helper()
+
+	clientConn.SetReadDeadline(time.Now().Add(d))
+	if replies.Scan() {
+		t.Errorf("client received %s", replies.Text())
+		return
+	}
+	if err, ok := replies.Err().(net.Error); !ok || !err.Timeout() {
+		t.Errorf("client connection failed: %v", replies.Err())
+	}
+}
+
+// TestTimeoutSparesReusedID checks that the timer of an answered request
+// doesn't time out the next request with the same id.
+func TestTimeoutSparesReusedID(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty", "--request-timeout", "400ms")
+	defer func() { *requestTimeout = 0 }()
+
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		requests := newMessageScanner(conn)
+		requests.Scan()
+		_, err := conn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"result":"first"}`))
+		if err != nil {
+			return err
+		}
+		requests.Scan()
+		// past the first request's timeout, within the second's
+		time.Sleep(300 * time.Millisecond)
+		_, err = conn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"result":"second"}`))
+		return err
+	})
+	defer hangUp()
+	replies := newMessageScanner(clientConn)
+
+	for _, want := range []string{`"first"`, `"second"`} {
+		_, err := clientConn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"Game.Fetch"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !replies.Scan() {
+			t.Fatalf("no reply: %v", replies.Err())
+		}
+		var reply RpcMessage
+		err = json.Unmarshal(replies.Bytes(), &reply)
+		if err != nil || reply.Result == nil || string(*reply.Result) != want {
+			t.Fatalf("got %s, want result %s", replies.Text(), want)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	err := <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTimeoutSparesAnsweredRequest checks that a request answered after
+// --observe-window ended doesn't get timed out as well.
+func TestTimeoutSparesAnsweredRequest(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty", "--request-timeout", "300ms", "--observe-window", "50ms")
+	defer func() { *requestTimeout, *observeWindow = 0, 0 }()
+
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		requests := newMessageScanner(conn)
+		requests.Scan()
+		// teacup only forwards by then, and won't see the reply
+		time.Sleep(100 * time.Millisecond)
+		_, err := conn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"result":"late"}`))
+		// hanging up would cancel the request
+		requests.Scan()
+		return err
+	})
+	defer hangUp()
+	replies := newMessageScanner(clientConn)
+
+	_, err := clientConn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"Game.Fetch"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replies.Scan() {
+		t.Fatalf("no reply: %v", replies.Err())
+	}
+	if want := `{"jsonrpc":"2.0","id":1,"result":"late"}`; replies.Text() != want {
+		t.Fatalf("got %s, want %s", replies.Text(), want)
+	}
+	expectNoMessage(t, clientConn, replies, 400*time.Millisecond)
+
+	hangUp()
+	err = <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDelayIsPerMessage checks that --delay holds each message for its
+// own delay, without holding up the other direction.
+func TestDelayIsPerMessage(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty", "--delay", "300ms", "--delay-direction", "in")
+	defer func() { *delay = 0 }()
+
+	var notifications []string
+	for i := 0; i < 5; i++ {
+		notifications = append(notifications, fmt.Sprintf(`{"jsonrpc":"2.0","method":"Tick","params":[%d]}`, i))
+	}
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		_, err := conn.Write(frames(t, notifications...))
+		if err != nil {
+			return err
+		}
+		requests := newMessageScanner(conn)
+		requests.Scan()
+		_, err = conn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"result":true}`))
+		return err
+	})
+	defer hangUp()
+	replies := newMessageScanner(clientConn)
+
+	start := time.Now()
+	_, err := clientConn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"Game.Fetch"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range append(notifications, `{"jsonrpc":"2.0","id":1,"result":true}`) {
+		if !replies.Scan() {
+			t.Fatalf("no message: %v", replies.Err())
+		}
+		if replies.Text() != want {
+			t.Fatalf("got %s, want %s", replies.Text(), want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("reply took %s with a 300ms delay", elapsed)
+	}
+
+	err = <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRateKeepsOtherDirection checks that --rate spaces out the messages
+// going one way without holding up the other.
+func TestRateKeepsOtherDirection(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty", "--rate", "5")
+	defer func() { *rateLimit = 0 }()
+
+	var notifications []string
+	for i := 0; i < 5; i++ {
+		notifications = append(notifications, fmt.Sprintf(`{"jsonrpc":"2.0","method":"Tick","params":[%d]}`, i))
+	}
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		_, err := conn.Write(frames(t, notifications...))
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		requests := newMessageScanner(conn)
+		requests.Scan()
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			return fmt.Errorf("request took %s to go through while notifications were throttled", elapsed)
+		}
+		return nil
+	})
+	defer hangUp()
+	replies := newMessageScanner(clientConn)
+
+	start := time.Now()
+	for i, want := range notifications {
+		if !replies.Scan() {
+			t.Fatalf("no message: %v", replies.Err())
+		}
+		if replies.Text() != want {
+			t.Fatalf("got %s, want %s", replies.Text(), want)
+		}
+		if i == 0 {
+			// while the others are held back
+			_, err := clientConn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"Game.Fetch"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the first one goes at once, then one every 200ms
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Errorf("5 notifications took %s at --rate 5", elapsed)
+	}
+
+	err := <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpstreamHangupClosesClient checks that by default, the client is
+// disconnected as soon as the upstream hangs up.
+func TestUpstreamHangupClosesClient(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty")
+
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		return nil
+	})
+	defer hangUp()
+
+	err := <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	clientConn.SetReadDeadline(start.Add(time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("client read %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("client was disconnected %s after the upstream hung up", elapsed)
+	}
+}
+
+// TestFailOnNegativeCode checks that the client is dropped after an error
+// reply with a negative --fail-on-code, as JSON-RPC's own codes are.
+func TestFailOnNegativeCode(t *testing.T) {
+	parseFlags(t, "--framing", framingLine, "--format", "pretty", "--fail-on-code=-32000")
+	defer func() { *failOnCodes = nil }()
+
+	clientConn, upstreamErr, hangUp := connectThroughProxy(t, func(conn net.Conn) error {
+		requests := newMessageScanner(conn)
+		requests.Scan()
+		_, err := conn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"busy"}}`))
+		// teacup hangs up, not us
+		requests.Scan()
+		return err
+	})
+	defer hangUp()
+	replies := newMessageScanner(clientConn)
+
+	_, err := clientConn.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"Game.Fetch"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replies.Scan() {
+		t.Fatalf("no reply: %v", replies.Err())
+	}
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	if replies.Scan() || replies.Err() != nil {
+		t.Fatalf("client read %q (%v), want EOF", replies.Text(), replies.Err())
+	}
+
+	err = <-upstreamErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
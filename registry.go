@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// BrokerRegistry keeps track of the brokers of all connections currently
+// being proxied, so they can be looked at from outside their connection.
+type BrokerRegistry struct {
+	mu      sync.Mutex
+	brokers map[*Broker]bool
+}
+
+// registry holds every live broker: newBroker adds them, Retire
+// removes them.
+var registry = &BrokerRegistry{brokers: make(map[*Broker]bool)}
+
+// Add records b as live.
+func (r *BrokerRegistry) Add(b *Broker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.brokers[b] = true
+}
+
+// Remove forgets b, once its connection is over.
+func (r *BrokerRegistry) Remove(b *Broker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.brokers, b)
+}
+
+// Snapshot returns the brokers that are live right now, in no particular
+// order. The slice is a copy, but the brokers aren't: lock them before
+// looking at their state.
+func (r *BrokerRegistry) Snapshot() []*Broker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := make([]*Broker, 0, len(r.brokers))
+	for b := range r.brokers {
+		res = append(res, b)
+	}
+	return res
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+// readCapturedRequests returns the client requests in a --log-dir capture,
+// in the order they were sent. Requests are logged again whenever they're
+// updated, so only the first record of each is kept.
+func readCapturedRequests(path string) ([]*Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	type key struct {
+		id    RpcID
+		start string
+	}
+	seen := make(map[key]bool)
+
+	var requests []*Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxMessageSize())
+	for line := 1; scanner.Scan(); line++ {
+		var logged LoggedEvent
+		err := json.Unmarshal(scanner.Bytes(), &logged)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+
+		ev := logged.Event
+		if ev == nil || ev.Kind != EventKindRequest || ev.Status == EventStatusOrphan || ev.Status == EventStatusDropped || ev.Inbound || ev.Start == nil {
+			continue
+		}
+		k := key{ev.ID, ev.Start.String()}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		requests = append(requests, ev)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return requests, nil
+}
+
+// replayRequests re-sends each client request of a capture to upstream,
+// one at a time, with fresh ids. It acts as a client of an in-process
+// teacup connection, so replies are observed exactly like live traffic.
+func replayRequests(capture string, upstream string) error {
+	requests, err := readCapturedRequests(capture)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replaying %d requests from %s against %s", len(requests), capture, upstream)
+
+	clientConn, proxyConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(proxyConn)
+	}()
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+
+	w := bufio.NewWriter(clientConn)
+	replies := newMessageScanner(clientConn)
+
+	// call sends a request and waits for its reply, skipping anything
+	// else the server sends in the meantime.
+	call := func(id RpcID, method string, params *json.RawMessage) (*RpcMessage, error) {
+		payload, err := json.Marshal(RpcMessage{
+			JSONRPC: jsonrpcVersion(),
+			ID:      id,
+			Method:  method,
+			Params:  params,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		err = writeFrame(w, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		for replies.Scan() {
+			var msg RpcMessage
+			if json.Unmarshal(replies.Bytes(), &msg) != nil {
+				continue
+			}
+			if msg.Method == "" && msg.ID == id {
+				return &msg, nil
+			}
+		}
+		err = replies.Err()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	connectParams, err := json.Marshal(ProxyConnectParams{Address: upstream})
+	must(err)
+	connectParamsRaw := json.RawMessage(connectParams)
+
+	res, err := call(NumericID(1), "Proxy.Connect", &connectParamsRaw)
+	if err != nil {
+		return errors.Wrap(err, "while connecting")
+	}
+	if res.Error != nil {
+		return errors.Errorf("while connecting: %s", res.Error.Message)
+	}
+
+	for i, req := range requests {
+		_, err := call(NumericID(int64(i+1)), req.Method, req.Params)
+		if err != nil {
+			return errors.Wrapf(err, "while replaying %s", req.Method)
+		}
+	}
+
+	log.Printf("Replayed %d requests", len(requests))
+	return nil
+}
+
+// replaySession prints the events of a --record or --log-dir file again,
+// through the same brokers as live traffic, waiting between events as
+// long as the original session did, divided by speed.
+func replaySession(path string, speed float64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	brokers := make(map[string]*Broker)
+	defer func() {
+		for _, b := range brokers {
+			b.mu.Lock()
+			// requests still pending weren't cancelled in the original
+			// session, the recording just stops there
+			b.InboundRequests = make(PendingRequests)
+			b.OutboundRequests = make(PendingRequests)
+			b.mu.Unlock()
+			b.Retire()
+		}
+	}()
+
+	var previous time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxMessageSize())
+	for line := 1; scanner.Scan(); line++ {
+		var logged LoggedEvent
+		err := json.Unmarshal(scanner.Bytes(), &logged)
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", path, line)
+		}
+
+		ev := logged.Event
+		if ev == nil || ev.Start == nil {
+			continue
+		}
+		at := *ev.Start
+		if ev.End != nil {
+			at = *ev.End
+		}
+
+		if speed > 0 && !previous.IsZero() && at.After(previous) {
+			time.Sleep(time.Duration(float64(at.Sub(previous)) / speed))
+		}
+		previous = at
+
+		key := logged.Connection + "@" + logged.ConnectedAt.String()
+		b := brokers[key]
+		if b == nil {
+			b = newBroker(logged.Connection, logged.ConnectedAt)
+			if attr, ok := colorAttribute(logged.Color); ok {
+				b.Color = color.New(attr)
+				b.ColorAttr = attr
+			}
+			b.LastActivity = logged.ConnectedAt
+			b.lastPrinted = logged.ConnectedAt
+			brokers[key] = b
+		}
+		b.replay(ev, at)
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+// replay prints ev, which was recorded at the time at, and updates the
+// broker's state as if it had just happened.
+func (b *Broker) replay(ev *Event, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Delta and --gap-marker measure from the current time, so shift the
+	// broker's own times to make them show the original gaps.
+	shift := time.Now().UTC().Sub(at)
+	connectedAt := b.ConnectedAt
+	lastPrinted := b.lastPrinted.Add(shift)
+	b.LastActivity = b.LastActivity.Add(shift)
+	b.ConnectedAt = connectedAt.Add(shift)
+	b.lastPrinted = lastPrinted
+	defer func() {
+		b.LastActivity = at
+		b.ConnectedAt = connectedAt
+		if b.lastPrinted == lastPrinted {
+			b.lastPrinted = lastPrinted.Add(-shift)
+		} else {
+			// the event was printed
+			b.lastPrinted = at
+		}
+	}()
+
+	ev.Broker = b
+	if ev.Kind != EventKindRequest || ev.Status == EventStatusOrphan || ev.Status == EventStatusDropped {
+		b.Events = append(b.Events, ev)
+		b.Updated(ev)
+		return
+	}
+
+	if ev.Status == EventStatusPending {
+		b.Updated(ev)
+		b.Events = append(b.Events, ev)
+		if ev.Inbound {
+			b.InboundRequests[ev.ID] = ev
+		} else {
+			b.OutboundRequests[ev.ID] = ev
+		}
+		return
+	}
+
+	if ev.Status == EventStatusErrored {
+		b.Errors++
+	}
+	b.Landed(ev)
+	b.Updated(ev)
+}
@@ -1,18 +1,195 @@
 package main
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
 
 type RpcMessage struct {
-	JSONRPC string           `json:"jsonrpc"`
-	ID      int64            `json:"id"`
+	JSONRPC string           `json:"jsonrpc,omitempty"`
+	ID      RpcID            `json:"id"`
 	Method  string           `json:"method,omitempty"`
 	Params  *json.RawMessage `json:"params,omitempty"`
 	Result  *json.RawMessage `json:"result,omitempty"`
 	Error   *RpcError        `json:"error,omitempty"`
 }
 
+// RpcID is a request id, which may be a number or a string. It holds the
+// id as JSON text, so it can be used as a map key: strings keep their
+// quotes, and numbers are written as integers when they're whole, so
+// that a reply with id 1.0 still matches request 1.
+//
+// The zero value means the message has no id at all, which is what makes
+// it a notification. An id of 0 or null is still an id: servers reply with
+// a null id to requests they couldn't parse.
+type RpcID string
+
+// NumericID returns the id for a request numbered by teacup itself.
+func NumericID(n int64) RpcID {
+	return RpcID(strconv.FormatInt(n, 10))
+}
+
+func (id *RpcID) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case nil:
+		*id = "null"
+	case string:
+		*id = RpcID(compactJSON(data))
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			*id = NumericID(n)
+		} else if f, err := v.Float64(); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			*id = NumericID(int64(f))
+		} else {
+			*id = RpcID(v.String())
+		}
+	default:
+		return fmt.Errorf("id must be a number or a string, not %s", compactJSON(data))
+	}
+	return nil
+}
+
+func (id RpcID) MarshalJSON() ([]byte, error) {
+	if id == "" {
+		return []byte("null"), nil
+	}
+	return []byte(id), nil
+}
+
+// value returns the id with numbers sent as strings turned back into
+// numbers, so that "1" and 1 compare equal, for peers that change an id's
+// type when echoing it.
+func (id RpcID) value() RpcID {
+	var s string
+	if !strings.HasPrefix(string(id), `"`) || json.Unmarshal([]byte(id), &s) != nil {
+		return id
+	}
+	if strings.TrimSpace(s) != s || !json.Valid([]byte(s)) {
+		return id
+	}
+	var number RpcID
+	if number.UnmarshalJSON([]byte(s)) != nil || number == "null" || strings.HasPrefix(string(number), `"`) {
+		return id
+	}
+	return number
+}
+
+// String returns the id for display: strings lose their quotes.
+func (id RpcID) String() string {
+	var s string
+	if strings.HasPrefix(string(id), `"`) && json.Unmarshal([]byte(id), &s) == nil {
+		return s
+	}
+	return string(id)
+}
+
+// RpcNotification is a message teacup sends on its own, that expects no reply.
+type RpcNotification struct {
+	JSONRPC string      `json:"jsonrpc,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
 type RpcError struct {
 	Code    int64            `json:"code"`
 	Message string           `json:"message"`
 	Data    *json.RawMessage `json:"data"`
 }
+
+// batchElements returns the messages of a JSON-RPC batch, which is an
+// array of requests, notifications or responses.
+func batchElements(msgString string) ([]json.RawMessage, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(msgString), "[") {
+		return nil, false
+	}
+
+	var batch []json.RawMessage
+	if json.Unmarshal([]byte(msgString), &batch) != nil {
+		return nil, false
+	}
+	return batch, true
+}
+
+// rawID returns the id of a message exactly as it appeared on the wire,
+// or nil if it has none.
+func rawID(msgString string) []byte {
+	var envelope struct {
+		ID *json.RawMessage `json:"id"`
+	}
+	err := json.Unmarshal([]byte(msgString), &envelope)
+	if err != nil || envelope.ID == nil {
+		return nil
+	}
+	return []byte(*envelope.ID)
+}
+
+// idReflected reports whether a response id matches the request id it
+// answers. In strict mode, the representation must be identical; otherwise,
+// ids need only have the same JSON type and value (so 1 and 1.0 match,
+// but "1" and 1 do not).
+func idReflected(req []byte, res []byte, strict bool) bool {
+	if strict {
+		return bytes.Equal(compactJSON(req), compactJSON(res))
+	}
+
+	var reqValue, resValue interface{}
+	if json.Unmarshal(req, &reqValue) != nil || json.Unmarshal(res, &resValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(reqValue, resValue)
+}
+
+func compactJSON(input []byte) []byte {
+	var buf bytes.Buffer
+	if json.Compact(&buf, input) != nil {
+		return input
+	}
+	return buf.Bytes()
+}
+
+var nonStandardNumbers = []string{"-Infinity", "Infinity", "NaN"}
+
+// nonStandardNumber returns the first NaN or Infinity literal found outside
+// of strings in msgString, which some serializers emit but isn't valid JSON.
+func nonStandardNumber(msgString string) string {
+	inString := false
+	escaped := false
+	for i := 0; i < len(msgString); i++ {
+		c := msgString[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+			continue
+		}
+		for _, literal := range nonStandardNumbers {
+			if strings.HasPrefix(msgString[i:], literal) {
+				return literal
+			}
+		}
+	}
+	return ""
+}
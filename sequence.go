@@ -0,0 +1,53 @@
+package main
+
+import "strings"
+
+// method patterns a session is expected to call, in order.
+// Patterns match by substring, like bannedMethods.
+var expectedSequence []string
+
+func parseSequence(list string) []string {
+	var seq []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			seq = append(seq, pattern)
+		}
+	}
+	return seq
+}
+
+// checkSequence advances the broker through expectedSequence
+// and warns about requests that skip ahead of it.
+func (b *Broker) checkSequence(ev *Event) {
+	if ev.Kind != EventKindRequest || ev.Status != EventStatusPending || b.SequenceStep >= len(expectedSequence) {
+		return
+	}
+
+	if strings.Contains(ev.Method, expectedSequence[b.SequenceStep]) {
+		b.SequenceStep++
+		b.announce("✓", "expected step %d/%d: %s", b.SequenceStep, len(expectedSequence), ev.Method)
+		return
+	}
+
+	for i := b.SequenceStep + 1; i < len(expectedSequence); i++ {
+		if strings.Contains(ev.Method, expectedSequence[i]) {
+			b.warn("%s is step %d, but step %d (%s) hasn't happened yet",
+				ev.Method, i+1, b.SequenceStep+1, expectedSequence[b.SequenceStep])
+			return
+		}
+	}
+}
+
+// reportSequence prints whether the whole expected sequence was seen.
+func (b *Broker) reportSequence() {
+	if len(expectedSequence) == 0 {
+		return
+	}
+
+	if b.SequenceStep == len(expectedSequence) {
+		b.announce("✓", "expected sequence completed")
+		return
+	}
+	b.warn("expected sequence incomplete, missing: %s", strings.Join(expectedSequence[b.SequenceStep:], ", "))
+}
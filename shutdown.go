@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownCtx is the parent of every connection's context: cancelling it
+// with beginShutdown makes all of them wrap up.
+var shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+
+// connections counts the handleConn goroutines started by acceptOne,
+// so shutdown can wait for them.
+var connections sync.WaitGroup
+
+// serve accepts clients on listener until shutdown begins.
+func serve(listener net.Listener) {
+	go func() {
+		<-shutdownCtx.Done()
+		listener.Close()
+	}()
+
+	for shutdownCtx.Err() == nil {
+		acceptOne(listener)
+	}
+}
+
+// shutdown waits up to --shutdown-timeout for connections to end after
+// beginShutdown, retires the brokers of those that didn't, and exits.
+func shutdown() {
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(*shutdownTimeout):
+		log.Printf("Gave up waiting for %d connections to close after %s", atomic.LoadInt64(&activeConns), *shutdownTimeout)
+	}
+
+	for _, b := range registry.Snapshot() {
+		b.Retire()
+	}
+	syncRecord()
+
+	if *listenSocket != "" {
+		os.Remove(*listenSocket)
+	}
+	if *assertNoOrphans {
+		os.Exit(checkCompleteness())
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Sink shows what teacup observes. Brokers keep track of events, and hand
+// them to the sink once they're updated; they never print by themselves.
+type Sink interface {
+	// Event shows ev, which was just added or updated
+	Event(b *Broker, ev *Event)
+	// Note shows something about the traffic that isn't a single event
+	Note(b *Broker, glyph string, c *color.Color, message string)
+}
+
+// where all brokers' events go, set by --format
+var sink Sink = prettySink{}
+
+// prettySink prints one colored line per event, with lineTemplate.
+type prettySink struct{}
+
+func (prettySink) Event(b *Broker, ev *Event) {
+	if ev.Kind == EventKindIdle {
+		b.Color.Printf("%s%s%s  %s %s\n", timestamp(*ev.Start), b.Delta(), depthMark(0), pad("broker", b.Name, maxBrokerWidth), ev)
+		linePrinted()
+		return
+	}
+	b.printEvent(ev)
+}
+
+func (prettySink) Note(b *Broker, glyph string, c *color.Color, message string) {
+	c.Printf("%s%s%s  %s %s %s\n", timestamp(time.Now().UTC()), b.Delta(), depthMark(0), pad("broker", b.Name, maxBrokerWidth), glyph, message)
+	linePrinted()
+}
+
+// jsonSink writes one JSON object per line, for other tools to consume.
+// Events have the same fields as in --record files.
+type jsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// JSONNote is how jsonSink writes notes.
+type JSONNote struct {
+	Connection string    `json:"connection"`
+	Kind       string    `json:"kind"`
+	Time       time.Time `json:"time"`
+	Glyph      string    `json:"glyph"`
+	Message    string    `json:"message"`
+}
+
+func (s *jsonSink) Event(b *Broker, ev *Event) {
+	s.write(b.loggedEvent(ev))
+}
+
+func (s *jsonSink) Note(b *Broker, glyph string, c *color.Color, message string) {
+	s.write(JSONNote{
+		Connection: b.Name,
+		Kind:       "note",
+		Time:       time.Now().UTC(),
+		Glyph:      glyph,
+		Message:    message,
+	})
+}
+
+func (s *jsonSink) write(v interface{}) {
+	payload, err := json.Marshal(v)
+	must(err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(payload, '\n'))
+	if err != nil {
+		log.Printf("While writing event: %+v", err)
+	}
+}
+
+// multiSink shows everything on each of its sinks, in order.
+type multiSink []Sink
+
+func (s multiSink) Event(b *Broker, ev *Event) {
+	for _, sink := range s {
+		sink.Event(b, ev)
+	}
+}
+
+func (s multiSink) Note(b *Broker, glyph string, c *color.Color, message string) {
+	for _, sink := range s {
+		sink.Note(b, glyph, c, message)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// formatSize returns a size in bytes the way people read them, e.g.
+// "312 B" or "1.4 KiB", or "" for 0, which means it isn't known.
+func formatSize(size int) string {
+	if size <= 0 {
+		return ""
+	}
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB"} {
+		value /= 1024
+		if value < 1024 || unit == "MiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// parenthesized returns the non-empty parts as " (a, b)", or "" if
+// they're all empty.
+func parenthesized(parts ...string) string {
+	var kept []string
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(kept, ", ") + ")"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ConnectionStatus is what --http-addr shows about a live connection.
+type ConnectionStatus struct {
+	Name             string    `json:"name"`
+	ConnectedAt      time.Time `json:"connectedAt"`
+	LastActivity     time.Time `json:"lastActivity"`
+	InboundRequests  int       `json:"pendingInbound"`
+	OutboundRequests int       `json:"pendingOutbound"`
+	TotalEvents      int       `json:"totalEvents"`
+	Errors           int       `json:"errors"`
+	// errors within the last --error-rate-window
+	RecentErrors int `json:"recentErrors"`
+}
+
+// Status returns the broker's current counts.
+func (b *Broker) Status() ConnectionStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return ConnectionStatus{
+		Name:             b.Name,
+		ConnectedAt:      b.ConnectedAt,
+		LastActivity:     b.LastActivity,
+		InboundRequests:  len(b.InboundRequests),
+		OutboundRequests: len(b.OutboundRequests),
+		TotalEvents:      len(b.Events),
+		Errors:           b.Errors,
+		RecentErrors:     b.recentErrors(),
+	}
+}
+
+// serveStatus answers GET requests on address with the status of every
+// live connection, as JSON.
+func serveStatus(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "teacup's status is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		connections := []ConnectionStatus{}
+		for _, b := range registry.Snapshot() {
+			connections = append(connections, b.Status())
+		}
+		sort.Slice(connections, func(i, j int) bool {
+			return connections[i].ConnectedAt.Before(connections[j].ConnectedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Connections []ConnectionStatus `json:"connections"`
+		}{connections})
+	})
+
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// statusWriter keeps a status line below everything written through it.
+// Output is buffered up to the last newline, so a line written in several
+// pieces (like colored ones) doesn't get the status line drawn in its middle.
+type statusWriter struct {
+	sync.Mutex
+	out     io.Writer
+	pending []byte
+	status  string
+}
+
+var sgrOnly = regexp.MustCompile(`^(\x1b\[[0-9;]*m)+$`)
+
+// when --status-line is enabled and stdout is a terminal, all output goes through this
+var status *statusWriter
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.pending = append(w.pending, p...)
+	if len(w.pending) > 0 && sgrOnly.Match(w.pending) {
+		// color changes don't move the cursor, no need to wait for a newline
+		_, err := w.out.Write(w.pending)
+		w.pending = w.pending[:0]
+		return len(p), err
+	}
+
+	i := bytes.LastIndexByte(w.pending, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	_, err := fmt.Fprintf(w.out, "\r\033[K%s", w.pending[:i+1])
+	w.pending = append(w.pending[:0], w.pending[i+1:]...)
+	if len(w.pending) == 0 {
+		w.draw()
+	}
+	return len(p), err
+}
+
+// SetStatus replaces the status line.
+func (w *statusWriter) SetStatus(s string) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.status = s
+	if len(w.pending) == 0 {
+		w.draw()
+	}
+}
+
+// draw prints the status line, in the default color, and leaves the
+// cursor at its start so the next line of output overwrites it.
+func (w *statusWriter) draw() {
+	fmt.Fprintf(w.out, "\r\033[K\033[0m%s\r", w.status)
+}
+
+// refreshStatus shows this broker's counts in the status line, if enabled.
+func (b *Broker) refreshStatus() {
+	if status == nil {
+		return
+	}
+
+	status.SetStatus(fmt.Sprintf("%s · %d events · pending %d→ %d← · %d errors",
+		b.Name, len(b.Events), len(b.OutboundRequests), len(b.InboundRequests), b.Errors))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// results teacup answers with on the server's behalf, by method, with --stub
+var stubs = make(map[string]*json.RawMessage)
+
+// loadStubs reads the result file of each method in files.
+func loadStubs(files map[string]string) error {
+	for method, path := range files {
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !json.Valid(payload) {
+			return errors.Errorf("%s: stub result for %s is not valid JSON", path, method)
+		}
+		result := json.RawMessage(compactJSON(payload))
+		stubs[method] = &result
+	}
+	return nil
+}
+
+// stubFor returns the id and stubbed result of msgString, if it's a
+// request for a stubbed method.
+func stubFor(msgString string) (RpcID, *json.RawMessage, bool) {
+	if len(stubs) == 0 {
+		return "", nil, false
+	}
+
+	var msg RpcMessage
+	err := json.Unmarshal([]byte(msgString), &msg)
+	if err != nil || msg.ID == "" {
+		return "", nil, false
+	}
+	result, ok := stubs[msg.Method]
+	return msg.ID, result, ok
+}
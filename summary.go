@@ -0,0 +1,36 @@
+package main
+
+import "sort"
+
+// printSummary shows how the requests of every live connection went
+// so far, for when teacup is interrupted mid-session.
+func printSummary() {
+	brokers := registry.Snapshot()
+	sort.Slice(brokers, func(i, j int) bool {
+		return brokers[i].ConnectedAt.Before(brokers[j].ConnectedAt)
+	})
+	for _, b := range brokers {
+		b.reportSummary()
+	}
+}
+
+func (b *Broker) reportSummary() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var completed, errored int
+	for _, ev := range b.Events {
+		if ev.Kind != EventKindRequest {
+			continue
+		}
+		switch ev.Status {
+		case EventStatusCompleted:
+			completed++
+		case EventStatusErrored:
+			errored++
+		}
+	}
+	pending := len(b.InboundRequests) + len(b.OutboundRequests)
+	b.announce("Σ", "%d completed, %d errored, %d pending requests, %d events",
+		completed, errored, pending, len(b.Events))
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// throttle spaces out the messages going one way so that no more than
+// --rate of them are forwarded per second, without bursts.
+type throttle struct {
+	// when the next message may go
+	next time.Time
+}
+
+// ready returns when a message due at due may go, at the earliest.
+func (t *throttle) ready(due time.Time) time.Time {
+	if *rateLimit <= 0 || t.next.Before(due) {
+		return due
+	}
+	return t.next
+}
+
+// sent makes the next message wait its turn after one that just went.
+func (t *throttle) sent() {
+	if *rateLimit <= 0 {
+		return
+	}
+	t.next = time.Now().Add(time.Duration(float64(time.Second) / *rateLimit))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// from RFC 6455, section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	websocketOpText  = 0x1
+	websocketOpClose = 0x8
+)
+
+// how many messages a WebSocket client may fall behind by before
+// it misses some
+const websocketBacklog = 256
+
+// how long writing a message to a WebSocket client may take
+const websocketWriteTimeout = 5 * time.Second
+
+// websocketHub sends everything written to it to every connected
+// WebSocket client, one message per Write. It never waits for clients:
+// messages for a client that's too far behind are dropped.
+type websocketHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+func newWebsocketHub() *websocketHub {
+	return &websocketHub{clients: make(map[chan []byte]bool)}
+}
+
+func (h *websocketHub) Write(p []byte) (int, error) {
+	msg := append([]byte(nil), p...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		select {
+		case client <- msg:
+		default:
+			// too slow, skip it rather than stall the proxy
+		}
+	}
+	return len(p), nil
+}
+
+// serveWebsocket streams every event and note, as --format json would
+// print them, to WebSocket clients connecting to address.
+func serveWebsocket(address string, hub *websocketHub) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           hub,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+func (h *websocketHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "teacup only streams events over WebSocket here", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("While upgrading WebSocket connection: %+v", err)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	client := make(chan []byte, websocketBacklog)
+	h.mu.Lock()
+	h.clients[client] = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		// clients have nothing to say, only notice when they leave
+		defer close(done)
+		readWebsocketFrames(rw.Reader)
+	}()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients, client)
+		h.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-client:
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			err := writeWebsocketFrame(conn, websocketOpText, msg)
+			if err != nil {
+				return
+			}
+		case <-done:
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			writeWebsocketFrame(conn, websocketOpClose, nil)
+			return
+		}
+	}
+}
+
+// writeWebsocketFrame writes payload as a single unmasked frame, as
+// servers send them.
+func writeWebsocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readWebsocketFrames skips the frames a client sends, and returns once
+// it closes the connection.
+func readWebsocketFrames(r *bufio.Reader) {
+	header := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return
+		}
+		if header[0]&0x0f == websocketOpClose {
+			return
+		}
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var n uint16
+			err = binary.Read(r, binary.BigEndian, &n)
+			length = uint64(n)
+		case 127:
+			err = binary.Read(r, binary.BigEndian, &length)
+		}
+		if err != nil {
+			return
+		}
+		if header[1]&0x80 != 0 {
+			// masking key
+			length += 4
+		}
+
+		_, err = io.CopyN(ioutil.Discard, r, int64(length))
+		if err != nil {
+			return
+		}
+	}
+}